@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anonymous is who made a request while authentication is off
+const anonymous = "anonymous"
+
+// Auth protects the control endpoints. Without tokens and users everybody
+// may control the player, as before. The streams, the now playing info,
+// the playlist and the artwork never need a login.
+type Auth struct {
+	// tokens maps names to static API tokens, sent by scripts as
+	// "Authorization: Bearer <token>"
+	tokens map[string]string
+	// users maps user names to passwords for HTTP basic auth, which the
+	// browser asks for when a button of the page needs it
+	users map[string]string
+	// protectUI asks for the login on the page too
+	protectUI bool
+
+	mu    sync.Mutex
+	audit *os.File
+}
+
+// NewAuth opens the audit log for appending, an empty path only logs
+func NewAuth(tokens, users map[string]string, protectUI bool, auditPath string) (*Auth, error) {
+	a := &Auth{tokens: tokens, users: users, protectUI: protectUI}
+	if auditPath != "" {
+		f, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.audit = f
+	}
+	return a, nil
+}
+
+// parseCredentials reads "name:secret,name:secret" lists from the
+// environment
+func parseCredentials(value string) (map[string]string, error) {
+	credentials := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("expected name:secret, got %q", entry)
+		}
+		credentials[name] = secret
+	}
+	return credentials, nil
+}
+
+func (a *Auth) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// authenticate returns who made a request, false when its credentials are
+// missing or wrong
+func (a *Auth) authenticate(r *http.Request) (string, bool) {
+	if !a.enabled() {
+		return anonymous, true
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for name, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return "token:" + name, true
+			}
+		}
+		return "", false
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if p, ok := a.users[user]; ok && subtle.ConstantTimeCompare([]byte(password), []byte(p)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// unauthorized answers a request that needs a login, browsers show their
+// login prompt when basic auth is configured
+func (a *Auth) unauthorized(w http.ResponseWriter) {
+	if len(a.users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="radio", charset="UTF-8"`)
+	}
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+}
+
+// Control guards an endpoint that changes what plays. Only authenticated
+// callers get through, and every call is audited, refused ones included.
+func (a *Auth) Control(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		who, ok := a.authenticate(r)
+		if !ok {
+			a.record(r, who, http.StatusUnauthorized)
+			a.unauthorized(w)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		a.record(r, who, rec.status)
+	}
+}
+
+// Page guards the web page, which needs a login only with protectUI
+func (a *Auth) Page(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.protectUI {
+			if _, ok := a.authenticate(r); !ok {
+				a.unauthorized(w)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+}
+
+// record notes who made a control request and how it went, in the log
+// and as a JSON line in the audit file
+func (a *Auth) record(r *http.Request, who string, status int) {
+	entry := auditEntry{
+		Time:   time.Now(),
+		User:   who,
+		Remote: r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Status: status,
+	}
+	if entry.User == "" {
+		entry.User = "-"
+	}
+	log.Printf("Audit: %s %s %s from %s: %d", entry.User, entry.Method, entry.Path, entry.Remote, entry.Status)
+
+	if a.audit == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.audit.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The PCM format decoders write and the broadcast encoder reads
+const (
+	sampleRate     = 44100
+	channelCount   = 2
+	frameSize      = 2 * channelCount
+	bytesPerSecond = sampleRate * frameSize
+)
+
+// silenceAfter is how long the decoders may stay quiet before silence is
+// fed to the encoder, so a gap between tracks doesn't stall the listeners
+const silenceAfter = 200 * time.Millisecond
+
+// silenceChunk is how much silence goes in at a time while nothing plays
+const silenceChunk = 100 * time.Millisecond
+
+// encoderIdle is how long an encoder runs without listeners before it is
+// stopped. The MP3 encoder always runs.
+const encoderIdle = 30 * time.Second
+
+// encoderBacklog is how many PCM writes may wait for an encoder. One that
+// falls further behind is restarted, so a stalled encoder never holds up
+// the other formats or the player.
+const encoderBacklog = 64
+
+// Broadcast is what every listener hears. The Player writes the decoded
+// PCM of the current track into it, and when nothing plays it is fed
+// silence so the streams never end. Each stream format has one encoder,
+// started when the first listener asks for it and shared from then on,
+// until it had no listeners for encoderIdle.
+type Broadcast struct {
+	mu         sync.Mutex
+	lastSource time.Time
+	encoders   map[string]*Encoder
+}
+
+func NewBroadcast() *Broadcast {
+	return &Broadcast{encoders: map[string]*Encoder{}}
+}
+
+// Write feeds whole PCM frames from a decoder to the encoders. Data is
+// dropped while an encoder restarts, the decoder never sees an error.
+func (b *Broadcast) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	b.lastSource = time.Now()
+	encoders := b.list()
+	b.mu.Unlock()
+
+	// The encoders get the PCM after the decoder reused its buffer
+	chunk := append([]byte(nil), p...)
+	for _, e := range encoders {
+		e.write(chunk)
+	}
+	return len(p), nil
+}
+
+// list returns the encoders, the caller must hold b.mu
+func (b *Broadcast) list() []*Encoder {
+	encoders := make([]*Encoder, 0, len(b.encoders))
+	for _, e := range b.encoders {
+		encoders = append(encoders, e)
+	}
+	return encoders
+}
+
+// encoder returns the encoder of a format, starting it on first use. The
+// caller must hold b.mu.
+func (b *Broadcast) encoder(format string) *Encoder {
+	e, ok := b.encoders[format]
+	if !ok {
+		ctx, stop := context.WithCancel(context.Background())
+		e = &Encoder{name: format, format: streamFormats[format], hub: NewHub(), stop: stop, idleSince: time.Now()}
+		b.encoders[format] = e
+		go e.run(ctx)
+	}
+	return e
+}
+
+// Join adds a listener to the encoder of a format, starting it on first
+// use. It returns the encoder with the stream header the listener has to
+// get first and the hub position to continue from.
+func (b *Broadcast) Join(format string) (*Encoder, []byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.encoder(format)
+	e.listeners++
+	header, pos := e.join()
+	return e, header, pos
+}
+
+// Leave removes a listener added by Join
+func (b *Broadcast) Leave(e *Encoder) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.listeners--
+	if e.listeners == 0 {
+		e.idleSince = time.Now()
+	}
+}
+
+// Run starts the MP3 encoder and keeps the silence feed going, it never
+// returns
+func (b *Broadcast) Run() {
+	b.mu.Lock()
+	b.encoder(formatMP3)
+	b.mu.Unlock()
+
+	go b.stopIdle()
+	b.feedSilence()
+}
+
+// stopIdle stops the encoders nobody listened to for encoderIdle, the
+// next listener of their format starts them again
+func (b *Broadcast) stopIdle() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.stopIdleEncoders()
+	}
+}
+
+func (b *Broadcast) stopIdleEncoders() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for format, e := range b.encoders {
+		if format == formatMP3 || e.listeners > 0 || time.Since(e.idleSince) < encoderIdle {
+			continue
+		}
+		log.Printf("No %s listeners for %s, encoder stopped", format, encoderIdle)
+		delete(b.encoders, format)
+		e.stop()
+	}
+}
+
+// feedSilence writes silence in real time while no decoder writes
+func (b *Broadcast) feedSilence() {
+	silence := make([]byte, int(silenceChunk.Seconds()*bytesPerSecond))
+	ticker := time.NewTicker(silenceChunk)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.mu.Lock()
+		var encoders []*Encoder
+		if time.Since(b.lastSource) >= silenceAfter {
+			encoders = b.list()
+		}
+		b.mu.Unlock()
+
+		for _, e := range encoders {
+			e.write(silence)
+		}
+	}
+}
+
+// Encoder turns the broadcast PCM into one stream format and fans it out
+// to the listeners of that format
+type Encoder struct {
+	name   string
+	format *streamFormat
+	hub    *Hub
+	stop   context.CancelFunc
+
+	// listeners counts who joined and idleSince is when the last one
+	// left, both are guarded by the Broadcast's mu
+	listeners int
+	idleSince time.Time
+
+	// pcmLock guards the PCM queue of the running process, which a
+	// goroutine of its own writes to its stdin, and how to kill it
+	pcmLock sync.Mutex
+	pcm     chan []byte
+	kill    context.CancelFunc
+
+	// headerLock keeps header in step with what the hub published
+	headerLock sync.Mutex
+	header     []byte
+}
+
+// write queues PCM for the encoder process if one runs. It never blocks,
+// a process that falls encoderBacklog writes behind is killed and
+// restarted instead. p must not be changed afterwards.
+func (e *Encoder) write(p []byte) {
+	e.pcmLock.Lock()
+	defer e.pcmLock.Unlock()
+	if e.pcm == nil {
+		return
+	}
+	select {
+	case e.pcm <- p:
+	default:
+		log.Printf("%s encoder fell behind, restarting it", e.name)
+		e.kill()
+		e.pcm = nil
+	}
+}
+
+// run keeps an encoder process going until ctx is done
+func (e *Encoder) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := e.encode(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%s encoder stopped: %v", e.name, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// encode runs one encoder process until it ends or ctx is done, and
+// publishes its output to the hub
+func (e *Encoder) encode(ctx context.Context) error {
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-f", "s16le", "-ar", strconv.Itoa(sampleRate), "-ac", strconv.Itoa(channelCount), "-i", "pipe:0"}
+	args = append(args, e.format.codec(e.format.bitrate)...)
+	args = append(args, "-flush_packets", "1", "pipe:1")
+	ctx, kill := context.WithCancel(ctx)
+	defer kill()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// A new process starts a new stream with its own header
+	var frames framer
+	if e.format.newFramer != nil {
+		frames = e.format.newFramer()
+	}
+	e.headerLock.Lock()
+	e.header = nil
+	e.headerLock.Unlock()
+
+	pcm := make(chan []byte, encoderBacklog)
+	go func() {
+		defer stdin.Close()
+		for p := range pcm {
+			if _, err := stdin.Write(p); err != nil {
+				kill()
+				return
+			}
+		}
+	}()
+	e.pcmLock.Lock()
+	e.pcm = pcm
+	e.kill = kill
+	e.pcmLock.Unlock()
+
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := stdout.Read(buf)
+		if n > 0 {
+			if frames == nil {
+				e.publish(buf[:n], false)
+			} else {
+				pending = append(pending, buf[:n]...)
+				for {
+					size, header := frames.next(pending)
+					if size == 0 {
+						break
+					}
+					e.publish(pending[:size], header)
+					pending = pending[size:]
+				}
+				pending = append([]byte(nil), pending...)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Nothing is queued for the process once its queue is closed
+	e.pcmLock.Lock()
+	if e.pcm == pcm {
+		e.pcm = nil
+	}
+	e.pcmLock.Unlock()
+	close(pcm)
+	return cmd.Wait()
+}
+
+// publish hands a unit of output to the listeners, remembering the header
+// for the ones that join later
+func (e *Encoder) publish(p []byte, header bool) {
+	e.headerLock.Lock()
+	defer e.headerLock.Unlock()
+	if header {
+		e.header = append(e.header, p...)
+	}
+	e.hub.Publish(p)
+}
+
+// join returns the stream header a new listener has to get first and the
+// hub position to continue from
+func (e *Encoder) join() ([]byte, int64) {
+	e.headerLock.Lock()
+	defer e.headerLock.Unlock()
+	return append([]byte(nil), e.header...), e.hub.Live()
+}
+
+// pcmSource passes the output of one decoder on in whole frames. Once
+// closed it drops everything, so what a killed decoder left in its pipe
+// never plays over the next track, and a decoder killed mid-sample can't
+// shift the channels of everything after it.
+type pcmSource struct {
+	mu     sync.Mutex
+	out    io.Writer
+	rest   []byte
+	closed bool
+}
+
+func newPCMSource(out io.Writer) *pcmSource {
+	return &pcmSource{out: out}
+}
+
+func (s *pcmSource) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return len(p), nil
+	}
+	data := append(s.rest, p...)
+	whole := len(data) - len(data)%frameSize
+	if whole > 0 {
+		s.out.Write(data[:whole])
+	}
+	s.rest = append([]byte(nil), data[whole:]...)
+	return len(p), nil
+}
+
+// Close drops everything written from now on
+func (s *pcmSource) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// hubSize is how many encoder reads the hub keeps. Listeners that fall
+// further behind skip ahead to the live point.
+const hubSize = 256
+
+// Hub fans the encoder output out to the listeners. New listeners start
+// at the live point, so everybody hears the same thing.
+type Hub struct {
+	mu     sync.Mutex
+	chunks [hubSize][]byte
+	next   int64
+	notify chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{notify: make(chan struct{})}
+}
+
+// Publish appends a chunk and wakes the waiting listeners
+func (h *Hub) Publish(p []byte) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	h.mu.Lock()
+	h.chunks[h.next%hubSize] = chunk
+	h.next++
+	close(h.notify)
+	h.notify = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// Live returns the position of the next chunk to be published
+func (h *Hub) Live() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.next
+}
+
+// Read waits for the chunk at pos and returns it with the position after
+// it. It returns an error once ctx is done.
+func (h *Hub) Read(ctx context.Context, pos int64) ([]byte, int64, error) {
+	for {
+		h.mu.Lock()
+		if pos < h.next-hubSize {
+			pos = h.next
+		}
+		if pos < h.next {
+			chunk := h.chunks[pos%hubSize]
+			h.mu.Unlock()
+			return chunk, pos + 1, nil
+		}
+		notify := h.notify
+		h.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, pos, ctx.Err()
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncoderWriteNeverBlocks(t *testing.T) {
+	killed := false
+	e := &Encoder{name: "test", pcm: make(chan []byte, encoderBacklog), kill: func() { killed = true }}
+
+	// Nothing drains the queue, as with a stalled encoder process
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= encoderBacklog; i++ {
+			e.write([]byte{0, 0, 0, 0})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked on a stalled encoder")
+	}
+	if !killed {
+		t.Error("encoder that fell behind wasn't killed")
+	}
+
+	// Writes while it restarts are dropped
+	e.write([]byte{0, 0, 0, 0})
+}
+
+func TestStopIdleEncoders(t *testing.T) {
+	b := NewBroadcast()
+	stopped := map[string]bool{}
+	add := func(format string, listeners int, idle time.Duration) {
+		b.encoders[format] = &Encoder{
+			name:      format,
+			stop:      func() { stopped[format] = true },
+			listeners: listeners,
+			idleSince: time.Now().Add(-idle),
+		}
+	}
+	add(formatMP3, 0, time.Hour)
+	add(formatAAC, 0, time.Hour)
+	add(formatOpus, 1, time.Hour)
+	add(formatFLAC, 0, time.Second)
+
+	b.stopIdleEncoders()
+	if !stopped[formatAAC] || b.encoders[formatAAC] != nil {
+		t.Error("idle AAC encoder still runs")
+	}
+	for _, format := range []string{formatMP3, formatOpus, formatFLAC} {
+		if stopped[format] || b.encoders[format] == nil {
+			t.Errorf("%s encoder was stopped", format)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Artwork sizes in pixels, the edge of the square the picture fits in
+const (
+	coverSize    = 300
+	maxCoverSize = 1200
+)
+
+// coverNames are the pictures looked for next to a track, best first.
+// Case doesn't matter.
+var coverNames = []string{"cover.jpg", "cover.jpeg", "cover.png", "folder.jpg", "folder.jpeg", "folder.png"}
+
+// Covers extracts and resizes track artwork into a cache folder. Entries
+// are keyed by the picture's source, its modification time and the size,
+// so they go stale by themselves when the files change.
+type Covers struct {
+	dir string
+	// mu keeps two requests from resizing the same picture at once
+	mu sync.Mutex
+}
+
+func NewCovers(dir string) *Covers {
+	return &Covers{dir: dir}
+}
+
+// Path returns the cached artwork of a track at the given size, creating
+// it first if needed. Embedded pictures win over the ones in the folder,
+// tracks without either get the default picture.
+func (c *Covers) Path(track Track, size int) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", err
+	}
+
+	for _, source := range coverSources(track) {
+		out := c.cachePath(source, size)
+		if _, err := os.Stat(out); err == nil {
+			return out, nil
+		}
+		if err := resizeCover(source, out, size); err != nil {
+			log.Printf("Error extracting artwork from %s: %v", source, err)
+			continue
+		}
+		return out, nil
+	}
+
+	out := c.cachePath("", size)
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+	return out, writeDefaultCover(out, size)
+}
+
+// cachePath names the cache entry of a source at a size, "" is the
+// default picture
+func (c *Covers) cachePath(source string, size int) string {
+	key := fmt.Sprintf("%s|%d", source, size)
+	if info, err := os.Stat(source); err == nil {
+		key += "|" + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	}
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:8])+".jpg")
+}
+
+// coverSources lists the files artwork may come from, best first
+func coverSources(track Track) []string {
+	sources := []string{}
+	if media, err := probeMedia(track.Path); err == nil && media.hasCover {
+		sources = append(sources, track.Path)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(track.Path))
+	if err != nil {
+		return sources
+	}
+	for _, name := range coverNames {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.ToLower(entry.Name()) == name {
+				sources = append(sources, filepath.Join(filepath.Dir(track.Path), entry.Name()))
+			}
+		}
+	}
+	return sources
+}
+
+// resizeCover writes the first picture of source, scaled to fit a square
+// of size, as a JPEG. The file only appears once it is complete.
+func resizeCover(source, out string, size int) error {
+	tmp := strings.TrimSuffix(out, ".jpg") + ".tmp.jpg"
+	cmd := exec.Command("ffmpeg", "-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", source,
+		"-map", "0:v:0", "-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size, size),
+		"-q:v", "3", "-update", "1",
+		tmp)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(tmp, out)
+}
+
+// writeDefaultCover draws a plain record for tracks without artwork
+func writeDefaultCover(out string, size int) error {
+	background := color.RGBA{0x55, 0x55, 0x55, 0xff}
+	vinyl := color.RGBA{0x22, 0x22, 0x22, 0xff}
+	label := color.RGBA{0x4c, 0xaf, 0x50, 0xff}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	center := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)+0.5-center, float64(y)+0.5-center
+			r := dx*dx + dy*dy
+			switch {
+			case r < center*center*0.01:
+				img.Set(x, y, background)
+			case r < center*center*0.12:
+				img.Set(x, y, label)
+			case r < center*center*0.81:
+				img.Set(x, y, vinyl)
+			default:
+				img.Set(x, y, background)
+			}
+		}
+	}
+
+	tmp := strings.TrimSuffix(out, ".jpg") + ".tmp.jpg"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 85}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, out)
+}
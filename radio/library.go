@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// readTags fills in the tags and length of every track with ffprobe,
+// several files at a time. Values an imported playlist already set stay.
+func readTags(tracks []Track) {
+	jobs := make(chan *Track)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				applyTags(t)
+			}
+		}()
+	}
+	for i := range tracks {
+		jobs <- &tracks[i]
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func applyTags(t *Track) {
+	if t.Added.IsZero() {
+		if info, err := os.Stat(t.Path); err == nil {
+			t.Added = info.ModTime()
+		}
+	}
+
+	media, err := probeMedia(t.Path)
+	if err != nil {
+		return
+	}
+	tags := media.tags
+
+	if t.Title == "" {
+		t.Title = tags["title"]
+	}
+	if t.Artist == "" {
+		t.Artist = tags["artist"]
+		if t.Artist == "" {
+			t.Artist = tags["album_artist"]
+		}
+	}
+	if t.Album == "" {
+		t.Album = tags["album"]
+	}
+	if t.Genre == "" {
+		t.Genre = tags["genre"]
+	}
+	if t.TrackNumber == 0 {
+		t.TrackNumber = tagNumber(tags["track"])
+	}
+	if t.Disc == 0 {
+		t.Disc = tagNumber(tags["disc"])
+	}
+	if t.Duration <= 0 {
+		t.Duration = media.duration
+	}
+}
+
+// DisplayTitle is what the page shows for a track
+func (t Track) DisplayTitle() string {
+	return displayTitle(t)
+}
+
+// foldTable maps letters with diacritics to the plain letters people type
+var foldTable = func() map[rune]string {
+	groups := map[string]string{
+		"a": "àáâãäåāăąǎ", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏőǒ", "r": "ŕŗř",
+		"s": "śŝşšș", "t": "ţťŧț", "u": "ùúûüũūŭůűųǔ", "w": "ŵ",
+		"y": "ýÿŷ", "z": "źżž", "ss": "ß", "ae": "æ", "oe": "œ", "th": "þ",
+		"е": "ё", "и": "й",
+	}
+	table := map[rune]string{}
+	for plain, letters := range groups {
+		for _, r := range letters {
+			table[r] = plain
+		}
+	}
+	return table
+}()
+
+// foldText lowercases s and strips diacritics, for matching
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.Is(unicode.Mn, r) {
+			// Combining marks of decomposed text
+			continue
+		}
+		if plain, ok := foldTable[r]; ok {
+			b.WriteString(plain)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// SearchQuery is a library search. Every word of Text has to appear in
+// one of the fields, the filters have to match a field as a whole.
+type SearchQuery struct {
+	Text   string
+	Artist string
+	Album  string
+	Genre  string
+}
+
+func (q SearchQuery) matches(t Track) bool {
+	if q.Artist != "" && foldText(t.Artist) != foldText(q.Artist) {
+		return false
+	}
+	if q.Album != "" && foldText(t.Album) != foldText(q.Album) {
+		return false
+	}
+	if q.Genre != "" && foldText(t.Genre) != foldText(q.Genre) {
+		return false
+	}
+
+	haystack := foldText(strings.Join([]string{t.Title, t.Artist, t.Album, t.Genre, t.Filename}, "\n"))
+	for _, word := range strings.Fields(foldText(q.Text)) {
+		if !strings.Contains(haystack, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns the tracks of the playlist matching q, in playlist order
+func (p *Player) Search(q SearchQuery) []Track {
+	results := []Track{}
+	for _, t := range p.GetPlaylist() {
+		if q.matches(t) {
+			results = append(results, t)
+		}
+	}
+	return results
+}
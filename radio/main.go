@@ -2,46 +2,47 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
-type Player struct {
-	playlist     []Track
-	currentIndex int
-	mu           sync.Mutex
-	ffmpegCmd    *exec.Cmd
-	isPlaying    bool
-}
-
 type Track struct {
 	ID       int    `json:"id"`
 	Path     string `json:"path"`
 	Filename string `json:"filename"`
 	Current  bool   `json:"current"`
+	// Read from the tags when the playlist is loaded, imported playlists
+	// may set them too. Duration is in seconds.
+	Title       string    `json:"title,omitempty"`
+	Artist      string    `json:"artist,omitempty"`
+	Album       string    `json:"album,omitempty"`
+	Disc        int       `json:"disc,omitempty"`
+	TrackNumber int       `json:"trackNumber,omitempty"`
+	Genre       string    `json:"genre,omitempty"`
+	Duration    float64   `json:"duration,omitempty"`
+	Added       time.Time `json:"added"`
 }
 
-func NewPlayer() *Player {
-	return &Player{
-		playlist:     []Track{},
-		currentIndex: 0,
-		isPlaying:    false,
+func (p *Player) ScanDirectory(root string) error {
+	tracks, err := scanDirectory(root)
+	if err != nil {
+		return err
 	}
+	p.SetPlaylist(tracks, root)
+	return nil
 }
 
-func (p *Player) ScanDirectory(root string) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.playlist = []Track{}
-	id := 1
+// scanDirectory lists the audio files below root
+func scanDirectory(root string) ([]Track, error) {
+	tracks := []Track{}
 
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -53,172 +54,34 @@ func (p *Player) ScanDirectory(root string) error {
 			strings.HasSuffix(strings.ToLower(path), ".flac") ||
 			strings.HasSuffix(strings.ToLower(path), ".ogg") ||
 			strings.HasSuffix(strings.ToLower(path), ".wav")) {
-			p.playlist = append(p.playlist, Track{
-				ID:       id,
+			tracks = append(tracks, Track{
 				Path:     path,
 				Filename: filepath.Base(path),
 				Current:  false,
+				Added:    info.ModTime(),
 			})
-			id++
 		}
 		return nil
 	})
 
-	// Sort playlist by filename for consistency
-	// You could implement a sort function here if needed
-
-	return err
+	// filepath.Walk goes in lexical order, so this is sorted by path
+	return tracks, err
 }
 
-func (p *Player) GenerateM3U(outputPath string) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if len(p.playlist) == 0 {
-		return fmt.Errorf("playlist is empty")
-	}
-
-	f, err := os.Create(outputPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// importSource prefixes the source of a playlist imported through the API,
+// the folder its relative entries were resolved against follows
+const importSource = "import:"
 
-	// Write M3U header
-	_, err = f.WriteString("#EXTM3U\n")
-	if err != nil {
-		return err
+// baseDir is the folder relative playlist entries are resolved against
+func (p *Player) baseDir() string {
+	source := p.Source()
+	if dir, ok := strings.CutPrefix(source, importSource); ok {
+		return dir
 	}
-
-	for _, track := range p.playlist {
-		_, err = f.WriteString(fmt.Sprintf("#EXTINF:-1,%s\n%s\n", track.Filename, track.Path))
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (p *Player) GetCurrentTrack() *Track {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if len(p.playlist) == 0 || p.currentIndex >= len(p.playlist) {
-		return nil
-	}
-
-	// Set all tracks to not current
-	for i := range p.playlist {
-		p.playlist[i].Current = false
-	}
-
-	// Set current track
-	p.playlist[p.currentIndex].Current = true
-
-	return &p.playlist[p.currentIndex]
-}
-
-func (p *Player) GetPlaylist() []Track {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// Return a copy of the playlist
-	playlistCopy := make([]Track, len(p.playlist))
-	copy(playlistCopy, p.playlist)
-
-	// Update the 'Current' flag
-	for i := range playlistCopy {
-		playlistCopy[i].Current = (i == p.currentIndex)
-	}
-
-	return playlistCopy
-}
-
-func (p *Player) Skip() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// Stop current playback if any
-	if p.ffmpegCmd != nil && p.ffmpegCmd.Process != nil {
-		p.ffmpegCmd.Process.Kill()
-		p.ffmpegCmd = nil
-	}
-
-	// Move to next track
-	if len(p.playlist) > 0 {
-		p.currentIndex = (p.currentIndex + 1) % len(p.playlist)
-	}
-
-	// If we're playing, start the next track
-	if p.isPlaying {
-		go p.startPlayback()
-	}
-}
-
-func (p *Player) startPlayback() {
-	p.mu.Lock()
-
-	// Stop any existing playback
-	if p.ffmpegCmd != nil && p.ffmpegCmd.Process != nil {
-		p.ffmpegCmd.Process.Kill()
-		p.ffmpegCmd = nil
-	}
-
-	if len(p.playlist) == 0 {
-		p.isPlaying = false
-		p.mu.Unlock()
-		return
-	}
-
-	p.isPlaying = true
-	currentTrack := p.playlist[p.currentIndex]
-	p.mu.Unlock()
-
-	log.Printf("Now playing: %s\n", currentTrack.Filename)
-
-	// Use ffmpeg to convert and stream to a "null" output
-	// This is just to keep track of playback and advance playlist
-	cmd := exec.Command("ffmpeg", "-nostdin", "-y", "-i", currentTrack.Path, "-f", "null", "-")
-	p.ffmpegCmd = cmd
-
-	// Run ffmpeg
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("Error playing track: %v", err)
-	}
-
-	// After track finishes, move to next track
-	p.mu.Lock()
-	if p.isPlaying {
-		p.currentIndex = (p.currentIndex + 1) % len(p.playlist)
-		p.mu.Unlock()
-		go p.startPlayback() // Start next track
-	} else {
-		p.mu.Unlock()
-	}
-}
-
-func (p *Player) Start() {
-	p.mu.Lock()
-	if !p.isPlaying && len(p.playlist) > 0 {
-		p.isPlaying = true
-		p.mu.Unlock()
-		go p.startPlayback()
-	} else {
-		p.mu.Unlock()
-	}
-}
-
-func (p *Player) Stop() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.isPlaying = false
-	if p.ffmpegCmd != nil && p.ffmpegCmd.Process != nil {
-		p.ffmpegCmd.Process.Kill()
-		p.ffmpegCmd = nil
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		return source
 	}
+	return filepath.Dir(source)
 }
 
 const indexHTML = `
@@ -260,6 +123,7 @@ const indexHTML = `
         }
         .playlist li {
             padding: 8px;
+            cursor: pointer;
             border-bottom: 1px solid #ddd;
         }
         .current {
@@ -272,20 +136,162 @@ const indexHTML = `
         audio {
             width: 100%;
         }
+        .artwork {
+            width: 300px;
+            height: 300px;
+            object-fit: contain;
+            background-color: #f5f5f5;
+        }
+        .progress {
+            height: 8px;
+            cursor: pointer;
+            background-color: #ddd;
+            border-radius: 4px;
+            overflow: hidden;
+        }
+        .progress div {
+            height: 100%;
+            width: 0;
+            background-color: #4CAF50;
+        }
+        .times {
+            display: flex;
+            justify-content: space-between;
+            color: #666;
+            font-size: 0.9em;
+        }
     </style>
     <script>
-        // Auto refresh current track info every 5 seconds
-        setInterval(function() {
-            fetch('/api/current')
+        var current = null;
+        var startedAt = 0;
+        var refreshTimer = null;
+
+        function displayTitle(track) {
+            var title = track.title || track.filename.replace(/\.[^.]*$/, '');
+            return track.artist ? track.artist + ' - ' + title : title;
+        }
+
+        function search() {
+            var q = document.getElementById('searchText').value;
+            fetch('/api/search?q=' + encodeURIComponent(q))
                 .then(response => response.json())
-                .then(data => {
-                    if (data) {
-                        document.getElementById('currentTrack').innerText = data.filename;
-                    } else {
-                        document.getElementById('currentTrack').innerText = "No track playing";
-                    }
+                .then(tracks => {
+                    var results = document.getElementById('searchResults');
+                    results.innerHTML = '';
+                    tracks.forEach(function(track) {
+                        var li = document.createElement('li');
+                        li.innerText = track.id + '. ' + displayTitle(track) + (track.album ? ' (' + track.album + ')' : '');
+                        li.onclick = function() { jump(track.id); };
+                        results.appendChild(li);
+                    });
                 });
-        }, 5000);
+        }
+
+        function formatSeconds(seconds) {
+            seconds = Math.max(0, Math.round(seconds));
+            var m = Math.floor(seconds / 60);
+            var s = seconds % 60;
+            return m + ':' + (s < 10 ? '0' : '') + s;
+        }
+
+        // Transport commands answer with the new state
+        function command(path, body) {
+            fetch(path, { method: 'POST', body: JSON.stringify(body || {}) })
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text); });
+                    }
+                    return response.json();
+                })
+                .then(showState)
+                .catch(err => alert(err.message));
+        }
+
+        function jump(id) {
+            command('/api/jump', { id: id });
+        }
+
+        function togglePause() {
+            command(current && current.playing ? '/api/pause' : '/api/resume');
+        }
+
+        function seek(event) {
+            if (!current || !(current.duration > 0)) {
+                return;
+            }
+            var bar = event.currentTarget.getBoundingClientRect();
+            command('/api/seek', { position: (event.clientX - bar.left) / bar.width * current.duration });
+        }
+
+        // Progress is counted locally, the server is only asked again
+        // when the track should be over
+        function refreshCurrent() {
+            fetch('/api/current')
+                .then(response => response.json())
+                .then(showState);
+        }
+
+        function showState(data) {
+            clearTimeout(refreshTimer);
+            current = data;
+            startedAt = Date.now() - (data ? data.elapsed * 1000 : 0);
+            document.getElementById('currentTrack').innerText = data ? displayTitle(data) : "No track playing";
+            var artwork = document.getElementById('artwork');
+            artwork.style.visibility = data ? 'visible' : 'hidden';
+            if (data && artwork.getAttribute('src') != data.artwork + '?size=300') {
+                artwork.setAttribute('src', data.artwork + '?size=300');
+            }
+            document.getElementById('pauseButton').innerText = data && data.playing ? 'Pause' : 'Play';
+            if (data) {
+                document.getElementById('repeat').value = data.repeat;
+            }
+            document.querySelectorAll('#playlist li').forEach(function(li) {
+                li.className = data && li.dataset.id == data.id ? 'current' : '';
+            });
+
+            var upcoming = document.getElementById('upcoming');
+            upcoming.innerHTML = '';
+            (data ? data.upcoming : []).forEach(function(track) {
+                var li = document.createElement('li');
+                var start = new Date(track.start).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+                li.innerText = start + ' ' + displayTitle(track);
+                upcoming.appendChild(li);
+            });
+
+            var wait = 30;
+            if (data && data.playing && data.duration > 0) {
+                wait = Math.min(wait, data.remaining + 1);
+            }
+            refreshTimer = setTimeout(refreshCurrent, wait * 1000);
+            updateProgress();
+        }
+
+        function updateProgress() {
+            var elapsed = 0, duration = 0;
+            if (current) {
+                duration = current.duration;
+                elapsed = current.playing ? Math.min(duration, (Date.now() - startedAt) / 1000) : current.elapsed;
+            }
+            document.getElementById('progressBar').style.width = (duration > 0 ? elapsed / duration * 100 : 0) + '%';
+            document.getElementById('elapsed').innerText = formatSeconds(elapsed);
+            document.getElementById('remaining').innerText = '-' + formatSeconds(duration - elapsed);
+        }
+
+        function setStreamFormat(format) {
+            var audio = document.getElementById('audioPlayer');
+            audio.src = '/stream?format=' + format;
+            audio.play();
+        }
+
+        function setOrder(order) {
+            fetch('/api/order', { method: 'POST', body: JSON.stringify({ order: order }) })
+                .then(() => location.reload());
+        }
+
+        window.onload = function() {
+            refreshCurrent();
+            setInterval(updateProgress, 1000);
+        };
     </script>
 </head>
 <body>
@@ -293,29 +299,58 @@ const indexHTML = `
     
     <div class="player-container">
         <h2>Web Player</h2>
-        <audio id="audioPlayer" controls autoplay>
-            <source src="/stream" type="audio/mp3">
+        <audio id="audioPlayer" controls autoplay src="/stream">
             Your browser does not support the audio element.
         </audio>
+        <select onchange="setStreamFormat(this.value)">
+            {{range .Formats}}
+            <option value="{{.}}"{{if eq . "mp3"}} selected{{end}}>{{.}}</option>
+            {{end}}
+        </select>
     </div>
     
     <div class="controls">
         <h2>Controls</h2>
-        <button onclick="location.href='/api/skip'">Skip to Next Track</button>
+        <button onclick="command('/api/previous')">Previous</button>
+        <button id="pauseButton" onclick="togglePause()">Pause</button>
+        <button onclick="command('/api/stop')">Stop</button>
+        <button onclick="command('/api/skip')">Skip to Next Track</button>
         <button onclick="location.reload()">Refresh Page</button>
+        <select id="repeat" onchange="command('/api/repeat', { repeat: this.value })">
+            {{range .Repeats}}
+            <option value="{{.}}"{{if eq . $.Repeat}} selected{{end}}>repeat {{.}}</option>
+            {{end}}
+        </select>
+        <select onchange="setOrder(this.value)">
+            {{range .Modes}}
+            <option value="{{.}}"{{if eq . $.Order}} selected{{end}}>{{.}}</option>
+            {{end}}
+        </select>
     </div>
     
     <div class="now-playing">
         <h2>Now Playing</h2>
-        <p id="currentTrack">{{if .Current}}{{.Current.Filename}}{{else}}No track playing{{end}}</p>
+        <img id="artwork" class="artwork" alt=""{{if .Current}} src="/api/cover/{{.Current.ID}}?size=300"{{end}}>
+        <p id="currentTrack">{{if .Current}}{{.Current.DisplayTitle}}{{else}}No track playing{{end}}</p>
+        <div class="progress" onclick="seek(event)"><div id="progressBar"></div></div>
+        <div class="times"><span id="elapsed">0:00</span><span id="remaining">-0:00</span></div>
+        <h3>Up Next</h3>
+        <ul class="playlist" id="upcoming"></ul>
     </div>
     
+    <div class="search">
+        <h2>Search</h2>
+        <input id="searchText" type="search" placeholder="Title, artist, album or genre" onkeydown="if (event.key == 'Enter') search()">
+        <button onclick="search()">Search</button>
+        <ul class="playlist" id="searchResults"></ul>
+    </div>
+
     <div class="playlist-container">
         <h2>Playlist</h2>
-        <ul class="playlist">
+        <ul class="playlist" id="playlist">
             {{range .Playlist}}
-            <li class="{{if .Current}}current{{end}}">
-                {{.ID}}. {{.Filename}}
+            <li class="{{if .Current}}current{{end}}" data-id="{{.ID}}" onclick="jump({{.ID}})">
+                {{.ID}}. {{.DisplayTitle}}{{if .Album}} <small>({{.Album}})</small>{{end}}
             </li>
             {{end}}
         </ul>
@@ -324,6 +359,30 @@ const indexHTML = `
 </html>
 `
 
+// writeState reports the current track and the transport state
+func writeState(w http.ResponseWriter, player *Player) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(player.NowPlaying())
+}
+
+// writeSource reports where the playlist came from and how long it is
+func writeSource(w http.ResponseWriter, player *Player) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"source": player.Source(),
+		"tracks": len(player.GetPlaylist()),
+	})
+}
+
+// writeOrder reports the ordering mode and the ones to choose from
+func writeOrder(w http.ResponseWriter, player *Player) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order": player.Order(),
+		"modes": orderModes,
+	})
+}
+
 func main() {
 	// Define default music directory
 	musicDir := "./music"
@@ -333,7 +392,8 @@ func main() {
 		musicDir = envDir
 	}
 
-	// Allow optional command line argument to override the directory
+	// Allow optional command line argument to override the directory. It
+	// may name a playlist file (.m3u, .pls, .xspf) instead of a folder.
 	if len(os.Args) > 1 {
 		musicDir = os.Args[1]
 	}
@@ -359,18 +419,50 @@ func main() {
 		log.Fatalf("ffmpeg not found: %v. Please install ffmpeg to use this player.", err)
 	}
 
-	player := NewPlayer()
+	// Stream bitrates in kbit/s, e.g. OPUS_BITRATE=48
+	for name, format := range streamFormats {
+		value := os.Getenv(strings.ToUpper(name) + "_BITRATE")
+		if value == "" || format.bitrate == 0 {
+			continue
+		}
+		bitrate, err := strconv.Atoi(value)
+		if err != nil || bitrate <= 0 {
+			log.Fatalf("Invalid %s bitrate: %s", name, value)
+		}
+		format.bitrate = bitrate
+	}
+
+	// One encoder per format feeds every listener
+	broadcast := NewBroadcast()
+	go broadcast.Run()
+
+	player := NewPlayer(broadcast, execRunner{})
+
+	// Repeat mode, see repeatModes
+	if repeat := os.Getenv("REPEAT"); repeat != "" {
+		if err := player.SetRepeat(repeat); err != nil {
+			log.Fatalf("Error setting repeat mode: %v", err)
+		}
+	}
+
+	// Playlist order, see orderModes
+	if order := os.Getenv("PLAYLIST_ORDER"); order != "" {
+		if err := player.SetOrder(order); err != nil {
+			log.Fatalf("Error setting playlist order: %v", err)
+		}
+	}
 
-	// Scan directory for audio files
-	log.Printf("Scanning directory: %s\n", musicDir)
-	err = player.ScanDirectory(musicDir)
+	// Scan directory for audio files, or load the playlist file
+	log.Printf("Loading playlist from: %s\n", musicDir)
+	err = player.LoadSource(musicDir)
 	if err != nil {
-		log.Fatalf("Error scanning directory: %v", err)
+		log.Fatalf("Error loading playlist: %v", err)
 	}
+	root := musicRoot(musicDir)
 
-	// Generate M3U playlist
+	// Export the playlist for other players
 	m3uPath := filepath.Join(outputDir, "playlist.m3u")
-	err = player.GenerateM3U(m3uPath)
+	err = player.ExportPlaylist(m3uPath)
 	if err != nil {
 		log.Printf("Error generating M3U: %v", err)
 	} else {
@@ -379,11 +471,38 @@ func main() {
 
 	log.Printf("Found %d audio files\n", len(player.GetPlaylist()))
 
+	// Control endpoints need a token or a login once either is set up,
+	// e.g. API_TOKENS=automation:s3cret and WEB_USERS=dj:hunter2
+	tokens, err := parseCredentials(os.Getenv("API_TOKENS"))
+	if err != nil {
+		log.Fatalf("Invalid API_TOKENS: %v", err)
+	}
+	users, err := parseCredentials(os.Getenv("WEB_USERS"))
+	if err != nil {
+		log.Fatalf("Invalid WEB_USERS: %v", err)
+	}
+	auditPath := filepath.Join(outputDir, "audit.log")
+	if envAudit, ok := os.LookupEnv("AUDIT_LOG"); ok {
+		auditPath = envAudit
+	}
+	// PROTECT_UI=true asks for the login on the page too
+	protectUI, _ := strconv.ParseBool(os.Getenv("PROTECT_UI"))
+	auth, err := NewAuth(tokens, users, protectUI, auditPath)
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	if !auth.enabled() {
+		log.Println("No API tokens or users configured, anybody may control the player")
+	}
+
+	// Artwork is resized once and kept next to the exported playlist
+	covers := NewCovers(filepath.Join(outputDir, "covers"))
+
 	// Create templates
 	indexTemplate := template.Must(template.New("index").Parse(indexHTML))
 
 	// Setup HTTP server
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/", auth.Page(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
@@ -392,24 +511,89 @@ func main() {
 		data := struct {
 			Current  *Track
 			Playlist []Track
+			Order    string
+			Modes    []string
+			Repeat   string
+			Repeats  []string
+			Formats  []string
 		}{
 			Current:  player.GetCurrentTrack(),
 			Playlist: player.GetPlaylist(),
+			Order:    player.Order(),
+			Modes:    orderModes,
+			Repeat:   player.Repeat(),
+			Repeats:  repeatModes,
+			Formats:  streamFormatNames(),
 		}
 
 		indexTemplate.Execute(w, data)
-	})
+	}))
+
+	// Transport controls, each answers with the new state
+	for path, action := range map[string]func(){
+		"/api/skip":     player.Skip,
+		"/api/previous": player.Previous,
+		"/api/pause":    player.Pause,
+		"/api/resume":   player.Resume,
+		"/api/stop":     player.Stop,
+	} {
+		action := action
+		http.HandleFunc("POST "+path, auth.Control(func(w http.ResponseWriter, r *http.Request) {
+			action()
+			writeState(w, player)
+		}))
+	}
 
-	// API endpoints
-	http.HandleFunc("/api/skip", func(w http.ResponseWriter, r *http.Request) {
-		player.Skip()
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-	})
+	// Seek in the current track, {"position": seconds}
+	http.HandleFunc("POST /api/seek", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Position float64 `json:"position"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := player.Seek(req.Position); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeState(w, player)
+	}))
+
+	// Play a track of the playlist, {"id": 12}
+	http.HandleFunc("POST /api/jump", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID int `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := player.Jump(req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeState(w, player)
+	}))
+
+	// Repeat mode, {"repeat": "off", "one" or "all"}
+	http.HandleFunc("POST /api/repeat", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Repeat string `json:"repeat"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := player.SetRepeat(req.Repeat); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeState(w, player)
+	}))
 
 	http.HandleFunc("/api/current", func(w http.ResponseWriter, r *http.Request) {
-		track := player.GetCurrentTrack()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(track)
+		writeState(w, player)
 	})
 
 	http.HandleFunc("/api/playlist", func(w http.ResponseWriter, r *http.Request) {
@@ -418,26 +602,195 @@ func main() {
 		json.NewEncoder(w).Encode(playlist)
 	})
 
-	// Stream endpoint - uses ffmpeg to transcode on the fly
-	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
-		track := player.GetCurrentTrack()
-		if track == nil {
-			http.Error(w, "No track available", http.StatusNotFound)
+	// Search across title, artist, album and genre, ?artist=, ?album= and
+	// ?genre= narrow it down
+	http.HandleFunc("GET /api/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		results := player.Search(SearchQuery{
+			Text:   query.Get("q"),
+			Artist: query.Get("artist"),
+			Album:  query.Get("album"),
+			Genre:  query.Get("genre"),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	http.HandleFunc("GET /api/order", func(w http.ResponseWriter, r *http.Request) {
+		writeOrder(w, player)
+	})
+
+	// Reorder without interrupting the current track
+	http.HandleFunc("POST /api/order", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Order string `json:"order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := player.SetOrder(req.Order); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		log.Printf("Playlist order changed to %s\n", req.Order)
+		writeOrder(w, player)
+	}))
+
+	// Switch between folders and playlist files below the music folder
+	// without a restart
+	http.HandleFunc("GET /api/source", func(w http.ResponseWriter, r *http.Request) {
+		writeSource(w, player)
+	})
 
-		w.Header().Set("Content-Type", "audio/mp3")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Transfer-Encoding", "chunked")
+	http.HandleFunc("POST /api/source", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if !withinDir(req.Path, root) {
+			http.Error(w, "path is outside the music folder", http.StatusForbidden)
+			return
+		}
+		if err := player.LoadSource(req.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Playlist source changed to %s\n", req.Path)
+		if err := player.ExportPlaylist(m3uPath); err != nil {
+			log.Printf("Error generating M3U: %v", err)
+		}
+		writeSource(w, player)
+	}))
+
+	// Playlist export, ?format=m3u, pls or xspf
+	http.HandleFunc("GET /api/playlist/export", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatM3U
+		}
+		contentType, ok := playlistContentTypes[format]
+		if !ok {
+			http.Error(w, "unknown playlist format", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=playlist."+format)
+		WritePlaylist(w, player.GetPlaylist(), format, player.baseDir())
+	})
+
+	// Playlist import from the request body, relative entries are resolved
+	// against the folder of the current source. Tracks outside the music
+	// folder are left out.
+	http.HandleFunc("POST /api/playlist/import", auth.Control(func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatM3U
+		}
+		base := player.baseDir()
+		parsed, err := ParsePlaylist(http.MaxBytesReader(w, r.Body, maxImportSize), format, base)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "playlist is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tracks := []Track{}
+		for _, track := range parsed {
+			if withinDir(track.Path, root) {
+				tracks = append(tracks, track)
+			}
+		}
+		if len(tracks) == 0 {
+			http.Error(w, "playlist has no tracks in the music folder", http.StatusBadRequest)
+			return
+		}
+		player.SetPlaylist(tracks, importSource+base)
+		log.Printf("Imported playlist with %d tracks\n", len(tracks))
+		if err := player.ExportPlaylist(m3uPath); err != nil {
+			log.Printf("Error generating M3U: %v", err)
+		}
+		writeSource(w, player)
+	}))
 
-		// Use ffmpeg to transcode the file to MP3 stream
-		cmd := exec.Command("ffmpeg", "-nostdin", "-i", track.Path, "-f", "mp3", "-acodec", "libmp3lame", "-ac", "2", "-ab", "128k", "-")
-		cmd.Stdout = w
-		cmd.Stderr = os.Stderr
+	// Artwork of a track, ?size= is the edge of the square it fits in
+	http.HandleFunc("GET /api/cover/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid track ID", http.StatusBadRequest)
+			return
+		}
+		track, ok := player.Track(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		size := coverSize
+		if s := r.URL.Query().Get("size"); s != "" {
+			size, err = strconv.Atoi(s)
+			if err != nil || size <= 0 {
+				http.Error(w, "invalid size", http.StatusBadRequest)
+				return
+			}
+			size = min(size, maxCoverSize)
+		}
 
-		err := cmd.Run()
+		path, err := covers.Path(track, size)
 		if err != nil {
-			log.Printf("Error streaming track: %v", err)
+			log.Printf("Error preparing artwork: %v", err)
+			http.Error(w, "artwork not available", http.StatusInternalServerError)
+			return
+		}
+		// IDs get reused when the playlist changes, so browsers check back
+		// and the entry name tells them whether the picture is the same
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(path), ".jpg")+`"`)
+		http.ServeFile(w, r, path)
+	})
+
+	// Stream endpoint - every listener joins the broadcast at the live
+	// point, ?format=mp3, aac, opus or flac
+	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		format, err := lookupStreamFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encoder, header, pos := broadcast.Join(format)
+		defer broadcast.Leave(encoder)
+
+		w.Header().Set("Content-Type", streamFormats[format].contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher, _ := w.(http.Flusher)
+
+		if len(header) > 0 {
+			if _, err := w.Write(header); err != nil {
+				return
+			}
+		}
+		// Answer right away, a new encoder takes a moment to start
+		if flusher != nil {
+			flusher.Flush()
+		}
+		for {
+			chunk, next, err := encoder.hub.Read(r.Context(), pos)
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			pos = next
 		}
 	})
 
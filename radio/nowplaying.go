@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// upcomingCount is how many tracks after the current one are announced,
+// with repeat one they are all the current track
+const upcomingCount = 5
+
+// NowPlaying is the current track with its playback position, in seconds
+type NowPlaying struct {
+	Track
+	Playing   bool       `json:"playing"`
+	Paused    bool       `json:"paused"`
+	Repeat    string     `json:"repeat"`
+	Artwork   string     `json:"artwork"`
+	StartedAt *time.Time `json:"startedAt"`
+	Elapsed   float64    `json:"elapsed"`
+	Remaining float64    `json:"remaining"`
+	Upcoming  []Upcoming `json:"upcoming"`
+}
+
+// Upcoming is a track due after the current one. Start is an estimate,
+// it assumes nobody skips.
+type Upcoming struct {
+	Track
+	Start time.Time `json:"start"`
+}
+
+// NowPlaying reports the current track, how far it got, and what follows.
+// It returns nil when the playlist is empty.
+func (p *Player) NowPlaying() *NowPlaying {
+	var np *NowPlaying
+	var position float64
+	upcoming := []Track{}
+	p.do(func() {
+		if len(p.playlist) == 0 || p.currentIndex >= len(p.playlist) {
+			return
+		}
+		np = &NowPlaying{
+			Track:   p.playlist[p.currentIndex],
+			Playing: p.isPlaying,
+			Paused:  p.paused,
+			Repeat:  p.repeat,
+		}
+		np.Current = true
+		np.Artwork = fmt.Sprintf("/api/cover/%d", np.ID)
+		position = p.position()
+		for i := 1; i <= upcomingCount; i++ {
+			index := p.currentIndex + i
+			if p.repeat == repeatOne {
+				// The current track plays again and again
+				index = p.currentIndex
+			} else if index >= len(p.playlist) && p.repeat == repeatOff {
+				break
+			}
+			upcoming = append(upcoming, p.playlist[index%len(p.playlist)])
+		}
+	})
+	if np == nil {
+		return nil
+	}
+
+	// ffprobe runs outside the playback goroutine, results are cached
+	// per file
+	np.Duration = trackDuration(np.Track)
+	now := time.Now()
+	if np.Playing || np.Paused {
+		np.Elapsed = position
+		if np.Duration > 0 && np.Elapsed > np.Duration {
+			np.Elapsed = np.Duration
+		}
+	}
+	if np.Playing {
+		// When the track would have started had nobody seeked
+		startedAt := now.Add(-time.Duration(np.Elapsed * float64(time.Second)))
+		np.StartedAt = &startedAt
+	}
+	np.Remaining = np.Duration - np.Elapsed
+	if np.Remaining < 0 {
+		np.Remaining = 0
+	}
+
+	np.Upcoming = []Upcoming{}
+	next := now.Add(time.Duration(np.Remaining * float64(time.Second)))
+	for _, track := range upcoming {
+		track.Duration = trackDuration(track)
+		np.Upcoming = append(np.Upcoming, Upcoming{Track: track, Start: next})
+		next = next.Add(time.Duration(track.Duration * float64(time.Second)))
+	}
+	return np
+}
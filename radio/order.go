@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Playlist ordering modes
+const (
+	// orderPlaylist keeps the order of the playlist file, folder scans
+	// come out sorted by path
+	orderPlaylist     = "playlist"
+	orderPath         = "path"
+	orderAlbum        = "album"
+	orderAdded        = "added"
+	orderShuffle      = "shuffle"
+	orderAlbumShuffle = "album-shuffle"
+)
+
+var orderModes = []string{orderPlaylist, orderPath, orderAlbum, orderAdded, orderShuffle, orderAlbumShuffle}
+
+func validOrder(mode string) bool {
+	for _, m := range orderModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// albumKey groups tracks into albums. Tracks without an album tag form one
+// album per folder.
+func albumKey(track Track) string {
+	if track.Album != "" {
+		return strings.ToLower(track.Album)
+	}
+	return "\x00" + filepath.Dir(track.Path)
+}
+
+// sortAlbumTracks orders the tracks of an album by disc, track number and
+// path
+func sortAlbumTracks(tracks []Track) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.TrackNumber != b.TrackNumber {
+			return a.TrackNumber < b.TrackNumber
+		}
+		return a.Path < b.Path
+	})
+}
+
+// orderTracks returns the tracks in the order of mode, using the tags
+// readTags filled in
+func orderTracks(tracks []Track, mode string) []Track {
+	ordered := append([]Track(nil), tracks...)
+
+	switch mode {
+	case orderPlaylist:
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+	case orderPath:
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Path < ordered[j].Path })
+	case orderAdded:
+		// Newest first, so fresh additions come up soon
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Added.After(ordered[j].Added) })
+	case orderShuffle:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case orderAlbum, orderAlbumShuffle:
+		albums := map[string][]Track{}
+		keys := []string{}
+		for _, t := range ordered {
+			key := albumKey(t)
+			if albums[key] == nil {
+				keys = append(keys, key)
+			}
+			albums[key] = append(albums[key], t)
+		}
+		if mode == orderAlbum {
+			sort.Strings(keys)
+		} else {
+			rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		}
+		ordered = ordered[:0]
+		for _, key := range keys {
+			sortAlbumTracks(albums[key])
+			ordered = append(ordered, albums[key]...)
+		}
+	}
+	return ordered
+}
+
+// Order returns the ordering mode of the playlist
+func (p *Player) Order() string {
+	var order string
+	p.do(func() { order = p.order })
+	return order
+}
+
+// SetOrder reorders the playlist. The current track keeps playing and the
+// playlist continues after it in the new order.
+func (p *Player) SetOrder(mode string) error {
+	if !validOrder(mode) {
+		return fmt.Errorf("unknown order %q", mode)
+	}
+
+	var tracks []Track
+	var version int
+	p.do(func() {
+		tracks = append([]Track(nil), p.playlist...)
+		version = p.version
+	})
+
+	ordered := orderTracks(tracks, mode)
+
+	var err error
+	p.do(func() {
+		if p.version != version {
+			err = fmt.Errorf("the playlist changed while it was being ordered")
+			return
+		}
+		currentID := 0
+		if p.currentIndex < len(p.playlist) {
+			currentID = p.playlist[p.currentIndex].ID
+		}
+		p.playlist = ordered
+		p.order = mode
+		p.version++
+		for i, t := range p.playlist {
+			if t.ID == currentID {
+				p.currentIndex = i
+			}
+		}
+	})
+	return err
+}
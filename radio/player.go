@@ -0,0 +1,345 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Player owns the playlist and the decoder of the current track. All of
+// its state belongs to one goroutine, the methods hand it commands and
+// wait for them to run, so a skip and a track ending at the same moment
+// are handled one after the other.
+type Player struct {
+	commands chan func()
+	quit     chan struct{}
+	stopped  chan struct{}
+	close    sync.Once
+	// runner starts the decoders, output receives their PCM
+	runner Runner
+	output io.Writer
+
+	// Everything below is only touched by the playback goroutine
+	playlist     []Track
+	currentIndex int
+	decoder      Process
+	pcm          *pcmSource
+	isPlaying    bool
+	// paused is set while a track waits to be resumed at offset
+	paused bool
+	// startedAt is when the decoder of the current track started, at
+	// offset seconds into the track
+	startedAt time.Time
+	offset    float64
+	repeat    string
+	// source is the folder or playlist file the playlist came from, or
+	// importSource and a folder for an imported one
+	source string
+	order  string
+	// version changes whenever the playlist is replaced or reordered
+	version int
+	// generation changes whenever a decoder is stopped, so the end of a
+	// decoder that was killed doesn't advance the playlist
+	generation int
+	// failures counts the tracks in a row that failed to play
+	failures int
+}
+
+func NewPlayer(output io.Writer, runner Runner) *Player {
+	p := &Player{
+		commands:     make(chan func()),
+		quit:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		runner:       runner,
+		output:       output,
+		playlist:     []Track{},
+		currentIndex: 0,
+		isPlaying:    false,
+		order:        orderPlaylist,
+		repeat:       repeatAll,
+	}
+	go p.run()
+	return p
+}
+
+// run executes the commands until the player is closed
+func (p *Player) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case command := <-p.commands:
+			command()
+		case <-p.quit:
+			p.stopDecoder()
+			return
+		}
+	}
+}
+
+// send queues a command without waiting for it, it returns false once the
+// player is closed
+func (p *Player) send(command func()) bool {
+	select {
+	case p.commands <- command:
+		return true
+	case <-p.quit:
+		return false
+	}
+}
+
+// do runs a command on the playback goroutine and waits for it
+func (p *Player) do(command func()) {
+	done := make(chan struct{})
+	if p.send(func() {
+		command()
+		close(done)
+	}) {
+		<-done
+	}
+}
+
+// Close stops playback and the playback goroutine, later commands are
+// ignored
+func (p *Player) Close() {
+	p.close.Do(func() { close(p.quit) })
+	<-p.stopped
+}
+
+// stopDecoder kills the running decoder and silences what it still has in
+// flight
+func (p *Player) stopDecoder() {
+	p.generation++
+	if p.pcm != nil {
+		p.pcm.Close()
+		p.pcm = nil
+	}
+	if p.decoder != nil {
+		p.decoder.Kill()
+		p.decoder = nil
+	}
+}
+
+// play starts decoding the current track from p.offset, in place of
+// whatever decoder ran before
+func (p *Player) play() {
+	p.stopDecoder()
+
+	if len(p.playlist) == 0 {
+		p.isPlaying = false
+		return
+	}
+
+	p.isPlaying = true
+	p.paused = false
+	generation := p.generation
+	currentTrack := p.playlist[p.currentIndex]
+
+	log.Printf("Now playing: %s\n", currentTrack.DisplayTitle())
+
+	// Decode in real time into the broadcast encoder, which every
+	// listener hears
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-re"}
+	if p.offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(p.offset, 'f', 3, 64))
+	}
+	args = append(args, "-i", currentTrack.Path,
+		"-vn", "-f", "s16le", "-ar", strconv.Itoa(sampleRate), "-ac", strconv.Itoa(channelCount),
+		"pipe:1")
+	pcm := newPCMSource(p.output)
+	decoder, err := p.runner.Start("ffmpeg", args, pcm, func(err error) {
+		p.send(func() { p.trackEnded(generation, err) })
+	})
+	if err != nil {
+		// Move on like after a track that failed to play
+		go p.send(func() { p.trackEnded(generation, err) })
+		return
+	}
+	p.decoder = decoder
+	p.pcm = pcm
+	p.startedAt = time.Now()
+}
+
+// trackEnded moves on to the next track once a decoder is done, unless
+// the decoder was stopped on purpose. After tracks failed in a row it
+// waits a while first, so a missing decoder or an unmounted library
+// doesn't make it spin through the playlist.
+func (p *Player) trackEnded(generation int, err error) {
+	if generation != p.generation || !p.isPlaying {
+		return
+	}
+	p.decoder = nil
+	p.pcm = nil
+	if err == nil {
+		p.failures = 0
+		p.advance()
+		return
+	}
+
+	log.Printf("Error playing track: %v", err)
+	p.failures++
+	delay := failureBackoff(p.failures)
+	if delay == 0 {
+		p.advance()
+		return
+	}
+	log.Printf("%d tracks failed in a row, backing off for %s", p.failures, delay)
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-p.quit:
+			return
+		}
+		p.send(func() {
+			// Unless the player was stopped, skipped or closed meanwhile
+			if generation == p.generation && p.isPlaying {
+				p.advance()
+			}
+		})
+	}()
+}
+
+// maxBackoff caps the pause after tracks failed to play
+const maxBackoff = time.Minute
+
+// failureBackoff returns how long to wait before the next track after
+// failures tracks in a row failed. The first failure is likely the file,
+// more in a row suggest the machine, so wait twice as long after each.
+func failureBackoff(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	delay := time.Second << (failures - 2)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// advance plays the track after the one that ended
+func (p *Player) advance() {
+	p.offset = 0
+	next, ok := p.nextIndex(false)
+	p.currentIndex = next
+	if ok {
+		p.play()
+		return
+	}
+	log.Println("End of playlist")
+	p.stopDecoder()
+	p.isPlaying = false
+	p.startedAt = time.Time{}
+}
+
+// SetPlaylist replaces the playlist and starts over from its first track.
+// IDs follow the order tracks are listed in, the playlist is then put in
+// the current ordering mode. Reading the tags runs ffprobe on every new
+// file, which happens before the player is handed the result.
+func (p *Player) SetPlaylist(tracks []Track, source string) {
+	for i := range tracks {
+		tracks[i].ID = i + 1
+		tracks[i].Current = false
+	}
+	readTags(tracks)
+	tracks = orderTracks(tracks, p.Order())
+
+	p.do(func() {
+		p.playlist = tracks
+		p.version++
+		p.source = source
+		p.currentIndex = 0
+		p.offset = 0
+
+		if p.isPlaying {
+			p.play()
+		}
+	})
+}
+
+// Source returns the folder or playlist file the playlist came from, or
+// importSource and the base folder when it was imported
+func (p *Player) Source() string {
+	var source string
+	p.do(func() { source = p.source })
+	return source
+}
+
+// GetCurrentTrack returns a copy of the current track, nil when the
+// playlist is empty
+func (p *Player) GetCurrentTrack() *Track {
+	var current *Track
+	p.do(func() {
+		if len(p.playlist) == 0 || p.currentIndex >= len(p.playlist) {
+			return
+		}
+		track := p.playlist[p.currentIndex]
+		track.Current = true
+		current = &track
+	})
+	return current
+}
+
+// Track returns the track with the given ID
+func (p *Player) Track(id int) (Track, bool) {
+	var track Track
+	found := false
+	p.do(func() {
+		for _, t := range p.playlist {
+			if t.ID == id {
+				track, found = t, true
+				return
+			}
+		}
+	})
+	return track, found
+}
+
+func (p *Player) GetPlaylist() []Track {
+	var playlistCopy []Track
+	p.do(func() {
+		// Return a copy of the playlist
+		playlistCopy = make([]Track, len(p.playlist))
+		copy(playlistCopy, p.playlist)
+
+		// Update the 'Current' flag
+		for i := range playlistCopy {
+			playlistCopy[i].Current = (i == p.currentIndex)
+		}
+	})
+	return playlistCopy
+}
+
+func (p *Player) Start() {
+	p.do(func() {
+		if !p.isPlaying && len(p.playlist) > 0 {
+			p.play()
+		}
+	})
+}
+
+func (p *Player) Stop() {
+	p.do(func() {
+		p.isPlaying = false
+		p.paused = false
+		p.startedAt = time.Time{}
+		p.offset = 0
+		p.stopDecoder()
+	})
+}
+
+func (p *Player) Skip() {
+	p.do(func() {
+		p.offset = 0
+
+		// Move to next track, past the last one playback stops
+		next, ok := p.nextIndex(true)
+		p.currentIndex = next
+		if !ok {
+			p.isPlaying = false
+			p.paused = false
+			p.startedAt = time.Time{}
+		}
+		p.restart()
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner hands out decoders that run until they are killed or told to
+// finish
+type fakeRunner struct {
+	mu        sync.Mutex
+	processes []*fakeProcess
+	// gate, when set, holds every Start until it is closed
+	gate    chan struct{}
+	started chan struct{}
+	// fail, when set, is what every Start fails with
+	fail error
+	// killed tracks the ends of killed decoders still being reported
+	killed sync.WaitGroup
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{started: make(chan struct{}, 1000)}
+}
+
+func (r *fakeRunner) Start(name string, args []string, stdout io.Writer, exited func(error)) (Process, error) {
+	r.started <- struct{}{}
+	if r.gate != nil {
+		<-r.gate
+	}
+	if r.fail != nil {
+		return nil, r.fail
+	}
+
+	proc := &fakeProcess{runner: r, exited: exited}
+	for i, arg := range args[:len(args)-1] {
+		if arg == "-i" {
+			proc.path = args[i+1]
+		}
+	}
+	r.mu.Lock()
+	r.processes = append(r.processes, proc)
+	r.mu.Unlock()
+	return proc, nil
+}
+
+// running returns the decoders that are still going
+func (r *fakeRunner) running() []*fakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var running []*fakeProcess
+	for _, proc := range r.processes {
+		if !proc.ended() {
+			running = append(running, proc)
+		}
+	}
+	return running
+}
+
+func (r *fakeRunner) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.processes)
+}
+
+func (r *fakeRunner) last() *fakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.processes[len(r.processes)-1]
+}
+
+type fakeProcess struct {
+	runner *fakeRunner
+	path   string
+	exited func(error)
+	once   sync.Once
+	done   bool
+}
+
+// Kill is called by the player, which hears about the end later like
+// from a real process
+func (f *fakeProcess) Kill() error {
+	if f.end() {
+		f.runner.killed.Add(1)
+		go func() {
+			defer f.runner.killed.Done()
+			f.exited(errors.New("signal: killed"))
+		}()
+	}
+	return nil
+}
+
+// finish ends the decoder as if the track was over. It returns once the
+// player took the end in, so whatever the test does next comes after it.
+func (f *fakeProcess) finish() {
+	if f.end() {
+		f.exited(nil)
+	}
+}
+
+// end marks the decoder as ended, it returns false when it already was
+func (f *fakeProcess) end() bool {
+	first := false
+	f.once.Do(func() {
+		f.runner.mu.Lock()
+		f.done = true
+		f.runner.mu.Unlock()
+		first = true
+	})
+	return first
+}
+
+func (f *fakeProcess) ended() bool {
+	return f.done
+}
+
+func newTestPlayer(t *testing.T, runner *fakeRunner, tracks int) *Player {
+	t.Helper()
+
+	p := NewPlayer(io.Discard, runner)
+	t.Cleanup(p.Close)
+
+	playlist := []Track{}
+	for i := 0; i < tracks; i++ {
+		name := fmt.Sprintf("track%02d.mp3", i+1)
+		playlist = append(playlist, Track{Path: "/nonexistent/" + name, Filename: name})
+	}
+	p.SetPlaylist(playlist, "/nonexistent")
+	return p
+}
+
+// settle waits until the player handled the ends of the decoders it
+// killed
+func settle(p *Player, runner *fakeRunner) {
+	runner.killed.Wait()
+	p.GetCurrentTrack()
+}
+
+// checkPlaying fails unless exactly one decoder runs, and it plays the
+// current track
+func checkPlaying(t *testing.T, p *Player, runner *fakeRunner) {
+	t.Helper()
+
+	running := runner.running()
+	if len(running) != 1 {
+		t.Fatalf("%d decoders running, want 1", len(running))
+	}
+	current := p.GetCurrentTrack()
+	if current == nil || running[0].path != current.Path {
+		t.Fatalf("decoder plays %s, current track is %v", running[0].path, current)
+	}
+}
+
+func TestRapidSkip(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 7)
+	p.Start()
+
+	const skips = 100
+	var wg sync.WaitGroup
+	for i := 0; i < skips; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Skip()
+		}()
+	}
+	wg.Wait()
+	settle(p, runner)
+
+	checkPlaying(t, p, runner)
+	if current := p.GetCurrentTrack(); current.ID != skips%7+1 {
+		t.Errorf("current track is %d, want %d after %d skips", current.ID, skips%7+1, skips)
+	}
+	if got := runner.count(); got != skips+1 {
+		t.Errorf("%d decoders started, want %d", got, skips+1)
+	}
+}
+
+func TestStopDuringStart(t *testing.T) {
+	runner := newFakeRunner()
+	runner.gate = make(chan struct{})
+	p := newTestPlayer(t, runner, 3)
+
+	go p.Start()
+	<-runner.started
+
+	// Stop arrives while the decoder is still being started
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the start it raced with")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(runner.gate)
+	<-stopped
+	settle(p, runner)
+
+	if running := runner.running(); len(running) != 0 {
+		t.Errorf("%d decoders still running after Stop", len(running))
+	}
+	if np := p.NowPlaying(); np.Playing {
+		t.Error("player still playing after Stop")
+	}
+}
+
+func TestStopStartRace(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p.Start()
+		}()
+		go func() {
+			defer wg.Done()
+			p.Stop()
+		}()
+	}
+	wg.Wait()
+	p.Stop()
+	settle(p, runner)
+
+	if running := runner.running(); len(running) != 0 {
+		t.Errorf("%d decoders still running after Stop", len(running))
+	}
+}
+
+func TestTrackEndRacingSkip(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		runner := newFakeRunner()
+		p := newTestPlayer(t, runner, 5)
+		p.Start()
+
+		ending := runner.last()
+		done := make(chan struct{})
+		go func() {
+			ending.finish()
+			close(done)
+		}()
+		p.Skip()
+		<-done
+		settle(p, runner)
+
+		// Either the skip came first and the end of the killed decoder
+		// is ignored, or the track ended and the skip moved on from the
+		// next one. It must never advance twice for one skip.
+		checkPlaying(t, p, runner)
+		if id := p.GetCurrentTrack().ID; id != 2 && id != 3 {
+			t.Fatalf("current track is %d, want 2 or 3", id)
+		}
+		p.Close()
+	}
+}
+
+func TestTrackEndAdvances(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 2)
+	p.SetRepeat(repeatOff)
+	p.Start()
+
+	runner.last().finish()
+	settle(p, runner)
+	checkPlaying(t, p, runner)
+	if id := p.GetCurrentTrack().ID; id != 2 {
+		t.Fatalf("current track is %d after the first ended, want 2", id)
+	}
+
+	// With repeat off the end of the last track stops playback
+	runner.last().finish()
+	settle(p, runner)
+	if running := runner.running(); len(running) != 0 {
+		t.Errorf("%d decoders running after the last track", len(running))
+	}
+	if np := p.NowPlaying(); np.Playing || np.ID != 1 {
+		t.Errorf("after the last track: playing %v on track %d, want stopped on 1", np.Playing, np.ID)
+	}
+}
+
+func TestUpcomingRepeatOne(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 3)
+	p.SetRepeat(repeatOne)
+	p.Start()
+
+	np := p.NowPlaying()
+	if len(np.Upcoming) != upcomingCount {
+		t.Fatalf("%d upcoming tracks, want %d", len(np.Upcoming), upcomingCount)
+	}
+	for i, track := range np.Upcoming {
+		if track.ID != np.ID {
+			t.Errorf("upcoming track %d is %d, want the current track %d again", i, track.ID, np.ID)
+		}
+	}
+
+	// Without repeat the list ends with the playlist
+	p.SetRepeat(repeatOff)
+	if np := p.NowPlaying(); len(np.Upcoming) != 2 || np.Upcoming[0].ID != 2 {
+		t.Errorf("upcoming %v with repeat off, want tracks 2 and 3", np.Upcoming)
+	}
+}
+
+func TestUpcomingRepeatAllWraps(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 1)
+	p.SetRepeat(repeatAll)
+	p.Start()
+
+	// A single track comes round again and again
+	np := p.NowPlaying()
+	if len(np.Upcoming) != upcomingCount {
+		t.Fatalf("%d upcoming tracks for one track on repeat, want %d", len(np.Upcoming), upcomingCount)
+	}
+	for i, track := range np.Upcoming {
+		if track.ID != 1 {
+			t.Errorf("upcoming track %d is %d, want 1", i, track.ID)
+		}
+	}
+
+	p.SetPlaylist([]Track{{Path: "/nonexistent/a.mp3"}, {Path: "/nonexistent/b.mp3"}}, "/nonexistent")
+	want := []int{2, 1, 2, 1, 2}
+	for i, track := range p.NowPlaying().Upcoming {
+		if track.ID != want[i] {
+			t.Errorf("upcoming track %d is %d, want %d", i, track.ID, want[i])
+		}
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for failures, delay := range want {
+		if got := failureBackoff(failures); got != delay {
+			t.Errorf("backoff after %d failures is %s, want %s", failures, got, delay)
+		}
+	}
+	if got := failureBackoff(100); got != maxBackoff {
+		t.Errorf("backoff after 100 failures is %s, want %s", got, maxBackoff)
+	}
+}
+
+func TestFailingStartsBackOff(t *testing.T) {
+	runner := newFakeRunner()
+	p := newTestPlayer(t, runner, 3)
+	runner.fail = errors.New("executable file not found")
+	p.Start()
+
+	// The first failure moves on at once, the second one waits
+	<-runner.started
+	<-runner.started
+	select {
+	case <-runner.started:
+		t.Fatal("a third track started right after two failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if np := p.NowPlaying(); !np.Playing || np.ID != 2 {
+		t.Errorf("playing %v on track %d while backing off, want playing 2", np.Playing, np.ID)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Playlist file formats, named by their usual extension
+const (
+	formatM3U  = "m3u"
+	formatPLS  = "pls"
+	formatXSPF = "xspf"
+)
+
+// playlistFormat picks the format from a file name, "" when it isn't a
+// playlist
+func playlistFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u", ".m3u8":
+		return formatM3U
+	case ".pls":
+		return formatPLS
+	case ".xspf":
+		return formatXSPF
+	}
+	return ""
+}
+
+// playlistContentTypes are the MIME types exports are served with
+var playlistContentTypes = map[string]string{
+	formatM3U:  "audio/x-mpegurl",
+	formatPLS:  "audio/x-scpls",
+	formatXSPF: "application/xspf+xml",
+}
+
+// LoadPlaylist reads a playlist file. Relative entries are resolved against
+// the folder the playlist is in.
+func LoadPlaylist(path string) ([]Track, error) {
+	format := playlistFormat(path)
+	if format == "" {
+		return nil, fmt.Errorf("unknown playlist format: %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParsePlaylist(f, format, filepath.Dir(path))
+}
+
+// ParsePlaylist reads a playlist in the given format. Relative entries are
+// resolved against base, entries that aren't local files are left out.
+func ParsePlaylist(r io.Reader, format, base string) ([]Track, error) {
+	var tracks []Track
+	var err error
+	switch format {
+	case formatM3U:
+		tracks, err = parseM3U(r)
+	case formatPLS:
+		tracks, err = parsePLS(r)
+	case formatXSPF:
+		tracks, err = parseXSPF(r)
+	default:
+		return nil, fmt.Errorf("unknown playlist format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := []Track{}
+	for _, track := range tracks {
+		path, ok := resolveEntry(track.Path, base)
+		if !ok {
+			continue
+		}
+		track.Path = path
+		track.Filename = filepath.Base(path)
+		resolved = append(resolved, track)
+	}
+	return resolved, nil
+}
+
+// resolveEntry turns a playlist entry into a local path. It returns false
+// for streams and other remote locations.
+func resolveEntry(entry, base string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return "", false
+	}
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme != "file" {
+			return "", false
+		}
+		entry = u.Path
+	}
+
+	// Playlists written on Windows use backslashes
+	entry = filepath.FromSlash(strings.ReplaceAll(entry, `\`, "/"))
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(base, entry)
+	}
+	return filepath.Clean(entry), true
+}
+
+// splitDisplayTitle splits the "Artist - Title" form playlists use
+func splitDisplayTitle(s string) (artist, title string) {
+	if a, t, ok := strings.Cut(s, " - "); ok {
+		return strings.TrimSpace(a), strings.TrimSpace(t)
+	}
+	return "", strings.TrimSpace(s)
+}
+
+func parseM3U(r io.Reader) ([]Track, error) {
+	tracks := []Track{}
+	var info *Track
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<seconds>[ attributes],<Artist - Title>
+			header, display, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			fields := strings.Fields(header)
+			info = &Track{}
+			if len(fields) > 0 {
+				if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil && seconds > 0 {
+					info.Duration = seconds
+				}
+			}
+			info.Artist, info.Title = splitDisplayTitle(display)
+		case strings.HasPrefix(line, "#"):
+		default:
+			track := Track{}
+			if info != nil {
+				track = *info
+			}
+			track.Path = line
+			tracks = append(tracks, track)
+			info = nil
+		}
+	}
+	return tracks, scanner.Err()
+}
+
+func parsePLS(r io.Reader) ([]Track, error) {
+	entries := map[int]*Track{}
+	entry := func(n int) *Track {
+		if entries[n] == nil {
+			entries[n] = &Track{}
+		}
+		return entries[n]
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(key)
+		for _, field := range []string{"file", "title", "length"} {
+			if !strings.HasPrefix(key, field) {
+				continue
+			}
+			n, err := strconv.Atoi(key[len(field):])
+			if err != nil {
+				continue
+			}
+			switch field {
+			case "file":
+				entry(n).Path = value
+			case "title":
+				entry(n).Artist, entry(n).Title = splitDisplayTitle(value)
+			case "length":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					entry(n).Duration = seconds
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	numbers := []int{}
+	for n := range entries {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	tracks := []Track{}
+	for _, n := range numbers {
+		if entries[n].Path != "" {
+			tracks = append(tracks, *entries[n])
+		}
+	}
+	return tracks, nil
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	// Duration is in milliseconds
+	Duration int64 `xml:"duration,omitempty"`
+}
+
+func parseXSPF(r io.Reader) ([]Track, error) {
+	var doc xspfPlaylist
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	tracks := []Track{}
+	for _, t := range doc.Tracks {
+		// Locations are URIs, relative ones are escaped too
+		location := t.Location
+		if !strings.Contains(location, "://") {
+			if unescaped, err := url.PathUnescape(location); err == nil {
+				location = unescaped
+			}
+		}
+		tracks = append(tracks, Track{
+			Path:     location,
+			Title:    t.Title,
+			Artist:   t.Creator,
+			Duration: float64(t.Duration) / 1000,
+		})
+	}
+	return tracks, nil
+}
+
+// maxImportSize caps the body of a playlist import
+const maxImportSize = 1 << 20
+
+// musicRoot is the folder sources and imported tracks have to lie in: the
+// music folder, or the folder of the playlist file the player started with
+func musicRoot(source string) string {
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		source = filepath.Dir(source)
+	}
+	return resolvePath(source)
+}
+
+// withinDir tells whether path lies in dir once symlinks are resolved
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(resolvePath(dir), resolvePath(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath makes path absolute and follows symlinks when it exists
+func resolvePath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// playlistEntry is how a track is listed in an exported playlist: relative
+// to base when it lies below it, absolute otherwise
+func playlistEntry(path, base string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if base != "" {
+		if absBase, err := filepath.Abs(base); err == nil {
+			if rel, err := filepath.Rel(absBase, abs); err == nil && !strings.HasPrefix(rel, "..") {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	return abs
+}
+
+// displayTitle is the "Artist - Title" form, the file name without
+// extension for untagged tracks
+func displayTitle(track Track) string {
+	title := track.Title
+	if title == "" {
+		title = strings.TrimSuffix(track.Filename, filepath.Ext(track.Filename))
+	}
+	if track.Artist != "" {
+		return track.Artist + " - " + title
+	}
+	return title
+}
+
+// trackDuration is the known length of a track, probed when the playlist
+// didn't say
+func trackDuration(track Track) float64 {
+	if track.Duration > 0 {
+		return track.Duration
+	}
+	duration, _ := probeDuration(track.Path)
+	return duration
+}
+
+// WritePlaylist exports tracks in the given format with paths relative to
+// base where possible
+func WritePlaylist(w io.Writer, tracks []Track, format, base string) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case formatM3U:
+		fmt.Fprint(bw, "#EXTM3U\n")
+		for _, track := range tracks {
+			duration := int(trackDuration(track) + 0.5)
+			if duration <= 0 {
+				duration = -1
+			}
+			fmt.Fprintf(bw, "#EXTINF:%d,%s\n%s\n", duration, displayTitle(track), playlistEntry(track.Path, base))
+		}
+	case formatPLS:
+		fmt.Fprint(bw, "[playlist]\n")
+		for i, track := range tracks {
+			duration := int(trackDuration(track) + 0.5)
+			if duration <= 0 {
+				duration = -1
+			}
+			fmt.Fprintf(bw, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", i+1, playlistEntry(track.Path, base), i+1, displayTitle(track), i+1, duration)
+		}
+		fmt.Fprintf(bw, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	case formatXSPF:
+		doc := xspfPlaylist{Version: "1"}
+		for _, track := range tracks {
+			location := playlistEntry(track.Path, base)
+			if filepath.IsAbs(location) {
+				location = (&url.URL{Scheme: "file", Path: filepath.ToSlash(location)}).String()
+			} else {
+				location = (&url.URL{Path: location}).EscapedPath()
+			}
+			title := track.Title
+			if title == "" {
+				title = strings.TrimSuffix(track.Filename, filepath.Ext(track.Filename))
+			}
+			doc.Tracks = append(doc.Tracks, xspfTrack{
+				Location: location,
+				Title:    title,
+				Creator:  track.Artist,
+				Duration: int64(trackDuration(track) * 1000),
+			})
+		}
+		fmt.Fprint(bw, xml.Header)
+		enc := xml.NewEncoder(bw)
+		enc.Indent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+		fmt.Fprint(bw, "\n")
+	default:
+		return fmt.Errorf("unknown playlist format: %s", format)
+	}
+	return bw.Flush()
+}
+
+// ExportPlaylist writes the playlist to a file, the format follows the
+// extension and paths are relative to the file's folder
+func (p *Player) ExportPlaylist(outputPath string) error {
+	tracks := p.GetPlaylist()
+	if len(tracks) == 0 {
+		return fmt.Errorf("playlist is empty")
+	}
+
+	format := playlistFormat(outputPath)
+	if format == "" {
+		return fmt.Errorf("unknown playlist format: %s", outputPath)
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return WritePlaylist(f, tracks, format, filepath.Dir(outputPath))
+}
+
+// LoadSource replaces the playlist with a folder scan or a playlist file
+func (p *Player) LoadSource(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	var tracks []Track
+	if info.IsDir() {
+		tracks, err = scanDirectory(source)
+	} else {
+		tracks, err = LoadPlaylist(source)
+	}
+	if err != nil {
+		return err
+	}
+	p.SetPlaylist(tracks, source)
+	return nil
+}
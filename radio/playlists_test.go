@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithinDir(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "jazz"), 0755)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{root, true},
+		{filepath.Join(root, "jazz"), true},
+		{filepath.Join(root, "jazz", "missing.mp3"), true},
+		{filepath.Join(root, "jazz", "..", ".."), false},
+		{filepath.Join(root, "escape"), false},
+		{outside, false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := withinDir(tt.path, root); got != tt.want {
+			t.Errorf("withinDir(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
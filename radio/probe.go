@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaInfo is what ffprobe tells about a track
+type mediaInfo struct {
+	modTime  time.Time
+	duration float64
+	// tags have lower case keys, stream tags fill in for format tags
+	tags map[string]string
+	// hasCover is set when the file embeds a picture
+	hasCover bool
+}
+
+var (
+	probed     = map[string]mediaInfo{}
+	probedLock sync.Mutex
+)
+
+// probeMedia reads the length, tags and embedded artwork of a track using
+// ffprobe. Results are remembered until the file changes.
+func probeMedia(path string) (mediaInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+
+	probedLock.Lock()
+	cached, ok := probed[path]
+	probedLock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+
+	cmd := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return mediaInfo{}, err
+	}
+
+	var result struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+			Tags map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return mediaInfo{}, err
+	}
+
+	media := mediaInfo{modTime: info.ModTime(), tags: map[string]string{}}
+	media.duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	audioTags := false
+	for _, s := range result.Streams {
+		switch {
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 1:
+			media.hasCover = true
+		case s.CodecType == "audio" && !audioTags:
+			// Ogg and Opus keep their tags on the stream
+			audioTags = true
+			for k, v := range s.Tags {
+				media.tags[strings.ToLower(k)] = v
+			}
+		}
+	}
+	for k, v := range result.Format.Tags {
+		media.tags[strings.ToLower(k)] = v
+	}
+
+	probedLock.Lock()
+	probed[path] = media
+	probedLock.Unlock()
+	return media, nil
+}
+
+// probeDuration returns the length of a track in seconds
+func probeDuration(path string) (float64, error) {
+	media, err := probeMedia(path)
+	return media.duration, err
+}
+
+// tagNumber reads numeric tags like "3" or "3/12"
+func tagNumber(value string) int {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+	n, _ := strconv.Atoi(value)
+	return n
+}
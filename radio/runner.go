@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Runner starts the decoder processes, tests swap in a fake one
+type Runner interface {
+	// Start runs a program with its output going to stdout. exited is
+	// called with the result once the program is done.
+	Start(name string, args []string, stdout io.Writer, exited func(error)) (Process, error)
+}
+
+// Process is a started decoder
+type Process interface {
+	Kill() error
+}
+
+// execRunner runs real programs
+type execRunner struct{}
+
+func (execRunner) Start(name string, args []string, stdout io.Writer, exited func(error)) (Process, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() { exited(cmd.Wait()) }()
+	return execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (e execProcess) Kill() error {
+	return e.cmd.Process.Kill()
+}
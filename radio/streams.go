@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Stream formats listeners can pick with /stream?format=
+const (
+	formatMP3  = "mp3"
+	formatAAC  = "aac"
+	formatOpus = "opus"
+	formatFLAC = "flac"
+)
+
+// streamFormat is how one output of the broadcast is encoded
+type streamFormat struct {
+	contentType string
+	// bitrate is in kbit/s, lossless formats have none
+	bitrate int
+	codec   func(bitrate int) []string
+	// newFramer returns the framer for one encoder process, nil when the
+	// output may be cut anywhere
+	newFramer func() framer
+}
+
+var streamFormats = map[string]*streamFormat{
+	formatMP3: {
+		contentType: "audio/mpeg",
+		bitrate:     128,
+		codec: func(bitrate int) []string {
+			return []string{"-c:a", "libmp3lame", "-b:a", strconv.Itoa(bitrate) + "k", "-f", "mp3"}
+		},
+	},
+	formatAAC: {
+		contentType: "audio/aac",
+		bitrate:     128,
+		codec: func(bitrate int) []string {
+			return []string{"-c:a", "aac", "-b:a", strconv.Itoa(bitrate) + "k", "-f", "adts"}
+		},
+	},
+	formatOpus: {
+		contentType: "audio/ogg; codecs=opus",
+		bitrate:     48,
+		codec: func(bitrate int) []string {
+			// Opus only runs at 48 kHz
+			return []string{"-c:a", "libopus", "-b:a", strconv.Itoa(bitrate) + "k", "-ar", "48000", "-f", "ogg"}
+		},
+		newFramer: func() framer { return &oggFramer{inHeader: true} },
+	},
+	formatFLAC: {
+		contentType: "audio/flac",
+		codec: func(int) []string {
+			return []string{"-c:a", "flac", "-f", "flac"}
+		},
+		newFramer: func() framer { return &flacFramer{} },
+	},
+}
+
+// streamAliases are other names the formats go by
+var streamAliases = map[string]string{
+	"adts": formatAAC,
+	"ogg":  formatOpus,
+}
+
+// lookupStreamFormat resolves the format a listener asked for, "" means
+// MP3
+func lookupStreamFormat(name string) (string, error) {
+	if name == "" {
+		return formatMP3, nil
+	}
+	if alias, ok := streamAliases[name]; ok {
+		name = alias
+	}
+	if _, ok := streamFormats[name]; !ok {
+		return "", fmt.Errorf("unknown stream format %q", name)
+	}
+	return name, nil
+}
+
+// streamFormatNames lists the formats for the page
+func streamFormatNames() []string {
+	names := []string{}
+	for name := range streamFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// framer cuts encoder output into the units listeners may join at. next
+// returns the length of the first unit in buf, 0 while it is incomplete,
+// and whether the unit is part of the stream header every listener needs
+// before the audio.
+type framer interface {
+	next(buf []byte) (n int, header bool)
+}
+
+var oggCapture = []byte("OggS")
+
+// oggFramer cuts an Ogg stream into pages. The pages before the first one
+// with a granule position carry the codec headers.
+type oggFramer struct {
+	inHeader bool
+}
+
+func (o *oggFramer) next(buf []byte) (int, bool) {
+	if !bytes.HasPrefix(buf, oggCapture) {
+		// Not at a page, pass everything up to the next one on
+		if i := bytes.Index(buf, oggCapture); i > 0 {
+			return i, false
+		}
+		if len(buf) > len(oggCapture) {
+			return len(buf) - len(oggCapture), false
+		}
+		return 0, false
+	}
+
+	const headerSize = 27
+	if len(buf) < headerSize {
+		return 0, false
+	}
+	segments := int(buf[26])
+	if len(buf) < headerSize+segments {
+		return 0, false
+	}
+	size := headerSize + segments
+	for _, lacing := range buf[headerSize : headerSize+segments] {
+		size += int(lacing)
+	}
+	if len(buf) < size {
+		return 0, false
+	}
+
+	if binary.LittleEndian.Uint64(buf[6:14]) != 0 {
+		o.inHeader = false
+	}
+	return size, o.inHeader
+}
+
+// flacFramer separates the "fLaC" marker and metadata blocks from the
+// frames, which decoders find by their sync code
+type flacFramer struct {
+	started    bool
+	headerDone bool
+}
+
+func (f *flacFramer) next(buf []byte) (int, bool) {
+	if f.headerDone {
+		return len(buf), false
+	}
+	if len(buf) < 4 {
+		return 0, false
+	}
+	if !f.started {
+		f.started = true
+		return 4, true
+	}
+
+	// Block header: last block flag, type, 24 bit length
+	last := buf[0]&0x80 != 0
+	length := int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+	if len(buf) < 4+length {
+		return 0, false
+	}
+	f.headerDone = last
+	return 4 + length, true
+}
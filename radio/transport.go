@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Repeat modes, what happens when a track ends
+const (
+	// repeatOff stops after the last track
+	repeatOff = "off"
+	// repeatOne plays the current track again
+	repeatOne = "one"
+	// repeatAll starts over after the last track
+	repeatAll = "all"
+)
+
+var repeatModes = []string{repeatOff, repeatOne, repeatAll}
+
+func validRepeat(mode string) bool {
+	for _, m := range repeatModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// previousRestart is how far into a track Previous goes back to its start
+// instead of to the track before
+const previousRestart = 3 * time.Second
+
+// position is how far the current track got, in seconds
+func (p *Player) position() float64 {
+	if p.isPlaying && !p.startedAt.IsZero() {
+		return p.offset + time.Since(p.startedAt).Seconds()
+	}
+	return p.offset
+}
+
+// nextIndex is the track that follows the current one. Skipping moves on
+// even when repeating one track. It returns false at the end of the
+// playlist with repeat off.
+func (p *Player) nextIndex(skipping bool) (int, bool) {
+	if len(p.playlist) == 0 {
+		return 0, false
+	}
+	if !skipping && p.repeat == repeatOne {
+		return p.currentIndex, true
+	}
+	if p.currentIndex+1 < len(p.playlist) {
+		return p.currentIndex + 1, true
+	}
+	return 0, p.repeat != repeatOff
+}
+
+// restart plays the current track from p.offset if the player is playing
+func (p *Player) restart() {
+	if p.isPlaying {
+		p.play()
+		return
+	}
+	p.stopDecoder()
+}
+
+// Previous goes back to the start of the current track, or to the track
+// before when the current one only just started
+func (p *Player) Previous() {
+	p.do(func() {
+		if len(p.playlist) == 0 {
+			return
+		}
+		if p.position() < previousRestart.Seconds() {
+			if p.currentIndex > 0 {
+				p.currentIndex--
+			} else if p.repeat != repeatOff {
+				p.currentIndex = len(p.playlist) - 1
+			}
+		}
+		p.offset = 0
+		p.restart()
+	})
+}
+
+// Pause stops the decoder and remembers the position, Resume continues
+// from there
+func (p *Player) Pause() {
+	p.do(func() {
+		if !p.isPlaying {
+			return
+		}
+		p.offset = p.position()
+		p.isPlaying = false
+		p.paused = true
+		p.startedAt = time.Time{}
+		p.stopDecoder()
+	})
+}
+
+// Resume continues a paused track, or starts a stopped player
+func (p *Player) Resume() {
+	p.Start()
+}
+
+// Seek moves to a position in the current track, in seconds. A paused
+// track stays paused.
+func (p *Player) Seek(seconds float64) error {
+	var err error
+	p.do(func() {
+		if len(p.playlist) == 0 {
+			err = fmt.Errorf("playlist is empty")
+			return
+		}
+		if seconds < 0 {
+			err = fmt.Errorf("position must not be negative")
+			return
+		}
+		if duration := p.playlist[p.currentIndex].Duration; duration > 0 && seconds >= duration {
+			err = fmt.Errorf("position is past the end of the track")
+			return
+		}
+		p.offset = seconds
+		p.restart()
+	})
+	return err
+}
+
+// Jump plays the track with the given ID from its start
+func (p *Player) Jump(id int) error {
+	err := fmt.Errorf("no track with ID %d", id)
+	p.do(func() {
+		for i, t := range p.playlist {
+			if t.ID == id {
+				p.currentIndex = i
+				p.offset = 0
+				p.play()
+				err = nil
+				return
+			}
+		}
+	})
+	return err
+}
+
+func (p *Player) Repeat() string {
+	var repeat string
+	p.do(func() { repeat = p.repeat })
+	return repeat
+}
+
+func (p *Player) SetRepeat(mode string) error {
+	if !validRepeat(mode) {
+		return fmt.Errorf("unknown repeat mode %q", mode)
+	}
+
+	p.do(func() { p.repeat = mode })
+	return nil
+}
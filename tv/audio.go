@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+type AudioConfig struct {
+	// Languages is the preferred order, and the rendition list when
+	// Renditions is on
+	Languages []string        `json:"languages"`
+	Overrides []AudioOverride `json:"overrides"`
+	// Renditions publishes every language as an alternate audio playlist
+	Renditions bool `json:"renditions"`
+}
+
+// AudioOverride replaces the preferred languages for files matching a glob
+// pattern, typically all episodes of one series like "Simpsons*"
+type AudioOverride struct {
+	Match     string   `json:"match"`
+	Languages []string `json:"languages"`
+}
+
+// audioRendition is one alternate audio playlist of the channel
+type audioRendition struct {
+	language string
+	playlist *LivePlaylist
+	// preferred carries the track the language preferences pick
+	preferred bool
+}
+
+func (ch *Channel) newAudioRenditions() []*audioRendition {
+	if !ch.config.Audio.Renditions {
+		// DASH needs audio and video apart, so there is always one
+		if ch.config.DASH {
+			lang := "und"
+			if len(ch.config.Audio.Languages) > 0 {
+				lang = normalizeLanguage(ch.config.Audio.Languages[0])
+			}
+			return []*audioRendition{{language: lang, playlist: ch.newPlaylist("audio.m3u8"), preferred: true}}
+		}
+		return nil
+	}
+
+	languages := ch.config.Audio.Languages
+	if len(languages) == 0 {
+		languages = []string{"und"}
+	}
+
+	renditions := []*audioRendition{}
+	for _, lang := range languages {
+		lang = normalizeLanguage(lang)
+		renditions = append(renditions, &audioRendition{
+			language: lang,
+			playlist: ch.newPlaylist("audio_" + lang + ".m3u8"),
+		})
+	}
+	return renditions
+}
+
+// audioLanguages returns the preferred languages for a video, taking the
+// first override whose pattern matches its library path or file name
+func (ch *Channel) audioLanguages(videoPath string) []string {
+	name := filepath.Base(videoPath)
+	rel, err := filepath.Rel(ch.config.VideoFolder, videoPath)
+	if err != nil {
+		rel = name
+	}
+
+	for _, o := range ch.config.Audio.Overrides {
+		if ok, _ := filepath.Match(o.Match, rel); ok {
+			return o.Languages
+		}
+		if ok, _ := filepath.Match(o.Match, name); ok {
+			return o.Languages
+		}
+	}
+	return ch.config.Audio.Languages
+}
+
+// selectAudio picks the stream for the first preferred language, then
+// the stream flagged as default, then the first one
+func selectAudio(streams []StreamInfo, languages []string) int {
+	for _, lang := range languages {
+		lang = normalizeLanguage(lang)
+		for _, s := range streams {
+			if s.Language == lang {
+				return s.TypeIndex
+			}
+		}
+	}
+	for _, s := range streams {
+		if s.Default {
+			return s.TypeIndex
+		}
+	}
+	return 0
+}
+
+// audioTrackCount is how many audio outputs every encode produces
+func (ch *Channel) audioTrackCount() int {
+	if renditions := len(ch.audioRenditions); renditions > 0 {
+		return renditions
+	}
+	return 1
+}
+
+// audioInputs returns the extra ffmpeg inputs and the -map values for the
+// audio outputs of an encode. Sources without audio get a silent track so
+// every program has the same layout and splices cleanly.
+func (ch *Channel) audioInputs(input string, mode encodeMode) ([]string, []string) {
+	streams, _ := probeStreams(input, "a")
+	if len(streams) == 0 {
+		maps := []string{}
+		for i := 0; i < ch.audioTrackCount(); i++ {
+			maps = append(maps, "1:a:0")
+		}
+		return []string{"-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo"}, maps
+	}
+
+	if mode == encodeClip {
+		maps := []string{}
+		for i := 0; i < ch.audioTrackCount(); i++ {
+			maps = append(maps, "0:a:0")
+		}
+		return nil, maps
+	}
+
+	selected := selectAudio(streams, ch.audioLanguages(input))
+	if len(ch.audioRenditions) == 0 {
+		return nil, []string{fmt.Sprintf("0:a:%d", selected)}
+	}
+
+	// Every rendition gets its language, or the selected track as stand-in
+	maps := []string{}
+	for _, r := range ch.audioRenditions {
+		index := selected
+		for _, s := range streams {
+			if !r.preferred && s.Language == r.language {
+				index = s.TypeIndex
+				break
+			}
+		}
+		maps = append(maps, fmt.Sprintf("0:a:%d", index))
+	}
+	return nil, maps
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig protects the control endpoints. Without tokens and users
+// everybody may control the channels, as before. Playlists, segments, the
+// guides and thumbnails never need a login.
+type AuthConfig struct {
+	// Tokens maps names to static API tokens, sent by scripts as
+	// "Authorization: Bearer <token>". The name shows up in the audit log.
+	Tokens map[string]string `json:"tokens"`
+	// Users maps user names to passwords for HTTP basic auth, which the
+	// browser asks for when a button of the web page needs it
+	Users map[string]string `json:"users"`
+	// ProtectPages asks for the basic auth login on the web pages too,
+	// not only when they control a channel
+	ProtectPages bool `json:"protectPages"`
+	// AuditLog is the file every control action is appended to, as JSON
+	// lines
+	AuditLog string `json:"auditLog"`
+}
+
+func (a AuthConfig) enabled() bool {
+	return len(a.Tokens) > 0 || len(a.Users) > 0
+}
+
+// anonymous is who made a request while authentication is off
+const anonymous = "anonymous"
+
+// authenticate returns who made a request, false when its credentials are
+// missing or wrong
+func authenticate(r *http.Request) (string, bool) {
+	auth := config.Auth
+	if !auth.enabled() {
+		return anonymous, true
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for name, t := range auth.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return "token:" + name, true
+			}
+		}
+		return "", false
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if p, ok := auth.Users[user]; ok && subtle.ConstantTimeCompare([]byte(password), []byte(p)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// unauthorized answers a request that needs a login, browsers show their
+// login prompt when basic auth is configured
+func unauthorized(w http.ResponseWriter) {
+	if len(config.Auth.Users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tv", charset="UTF-8"`)
+	}
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+}
+
+// control guards an endpoint that changes what a channel does. Only
+// authenticated callers get through, and every call is audited, refused
+// ones included.
+func control(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		who, ok := authenticate(r)
+		if !ok {
+			audit.Record(r, who, http.StatusUnauthorized)
+			unauthorized(w)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		audit.Record(r, who, rec.status)
+	}
+}
+
+// page guards a web page, which needs a login only with ProtectPages
+func page(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Auth.ProtectPages {
+			if _, ok := authenticate(r); !ok {
+				unauthorized(w)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+}
+
+// AuditLog appends control actions to a file, and to the log
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewAuditLog opens the audit file for appending, "" only logs
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+	return a, nil
+}
+
+// Record notes who made a control request and how it went
+func (a *AuditLog) Record(r *http.Request, who string, status int) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		User:   who,
+		Remote: r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Status: status,
+	}
+	if entry.User == "" {
+		entry.User = "-"
+	}
+	log.Printf("Audit: %s %s %s from %s: %d", entry.User, entry.Method, entry.Path, entry.Remote, entry.Status)
+
+	if a.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+func (a *AuditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscodeCache converts library items into HLS segment sets ahead of
+// time, so playout can publish them instead of encoding live. Entries are
+// keyed by a hash of the source and the encode profile of the channel.
+type TranscodeCache struct {
+	dir     string
+	workers int
+	budget  float64
+	jobs    chan cacheJob
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pending map[string]bool
+	hashes  map[string]sourceHash
+}
+
+// cacheJob is a source to transcode with the settings of a channel
+type cacheJob struct {
+	ch   *Channel
+	path string
+}
+
+type sourceHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// hashSampleSize is how much of the head and tail of a source gets hashed.
+// Reading whole multi-gigabyte files on every scan would be too slow.
+const hashSampleSize = 1 << 20
+
+func NewTranscodeCache(dir string, workers int, budget float64) *TranscodeCache {
+	if workers < 1 {
+		workers = 1
+	}
+	return &TranscodeCache{
+		dir:     dir,
+		workers: workers,
+		budget:  budget,
+		jobs:    make(chan cacheJob, 1024),
+		pending: map[string]bool{},
+		hashes:  map[string]sourceHash{},
+	}
+}
+
+// Start launches the background worker pool
+func (c *TranscodeCache) Start() {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for i := 0; i < c.workers; i++ {
+		c.wg.Add(1)
+		go c.worker()
+	}
+}
+
+// Stop terminates running transcodes and waits for the workers to exit.
+// Unfinished entries are discarded and redone on the next start.
+func (c *TranscodeCache) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+}
+
+// Enqueue schedules path for transcoding for ch unless it is cached or
+// queued already
+func (c *TranscodeCache) Enqueue(ch *Channel, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := ch.cacheProfile() + ":" + path
+	if c.pending[key] {
+		return
+	}
+	select {
+	case c.jobs <- cacheJob{ch: ch, path: path}:
+		c.pending[key] = true
+	default:
+		// The queue is full, the item is picked up again on the next refill
+	}
+}
+
+// Lookup returns the track sets of path cached for ch, if there are any
+func (c *TranscodeCache) Lookup(ch *Channel, path string) ([]*SegmentSet, bool) {
+	entry, err := c.entryDir(ch, path)
+	if err != nil {
+		return nil, false
+	}
+
+	sets, err := ch.readTrackSets(entry)
+	if err != nil {
+		return nil, false
+	}
+	for _, set := range sets {
+		if !set.Ended || len(set.Segments) == 0 {
+			return nil, false
+		}
+	}
+	return sets, true
+}
+
+func (c *TranscodeCache) entryDir(ch *Channel, path string) (string, error) {
+	hash, err := c.hash(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, ch.cacheProfile(), hash), nil
+}
+
+// hash identifies the source by its size and the bytes at both ends,
+// remembered until the file's size or modification time change
+func (c *TranscodeCache) hash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.hashes[path]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", info.Size())
+	if _, err := io.CopyN(h, f, hashSampleSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if info.Size() > 2*hashSampleSize {
+		if _, err := f.Seek(-hashSampleSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	hash := hex.EncodeToString(h.Sum(nil))[:32]
+
+	c.mu.Lock()
+	c.hashes[path] = sourceHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// cacheProfile names the cache folder for the encode settings of the
+// channel. The overlay, segment length, burned in subtitles, the audio
+// layout, the segment format and the encoding profile change the output,
+// so each combination gets its own entries and channels with the same
+// settings share them.
+func (ch *Channel) cacheProfile() string {
+	variant := struct {
+		Overlay     string
+		SegmentTime int
+		Subtitles   SubtitleConfig
+		Audio       AudioConfig
+		DASH        bool
+		Profile     EncodingProfile
+	}{Overlay: ch.config.Overlay, SegmentTime: ch.config.SegmentTime, Audio: ch.config.Audio, DASH: ch.config.DASH, Profile: ch.profile}
+	if ch.config.Subtitles.Mode == subtitlesBurn {
+		variant.Subtitles = ch.config.Subtitles
+	}
+
+	data, _ := json.Marshal(variant)
+	sum := sha256.Sum256(data)
+	return encodeVersion + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+func (c *TranscodeCache) worker() {
+	defer c.wg.Done()
+
+	for {
+		var job cacheJob
+		select {
+		case <-c.ctx.Done():
+			return
+		case job = <-c.jobs:
+		}
+
+		if _, ok := c.Lookup(job.ch, job.path); !ok && !quarantine.Has(job.path) && c.waitForBudget() {
+			err := c.transcode(job.ch, job.path)
+			var ferr *ffmpegError
+			if err != nil && c.ctx.Err() == nil {
+				log.Printf("Error transcoding %s: %v\n", job.path, err)
+				if errors.As(err, &ferr) && quarantine.RecordFailure(job.path, ferr) {
+					log.Printf("Quarantined %s after repeated failures\n", job.path)
+				}
+			}
+		}
+
+		c.mu.Lock()
+		delete(c.pending, job.ch.cacheProfile()+":"+job.path)
+		c.mu.Unlock()
+	}
+}
+
+// threads is the encoder thread count each worker gets from the CPU budget
+func (c *TranscodeCache) threads() int {
+	threads := int(c.budget*float64(runtime.NumCPU())) / c.workers
+	if threads < 1 {
+		threads = 1
+	}
+	return threads
+}
+
+// waitForBudget holds new jobs back while the machine is already saturated,
+// for example when playout has fallen back to live encoding. It returns
+// false when the cache is stopped while waiting.
+func (c *TranscodeCache) waitForBudget() bool {
+	for {
+		data, err := os.ReadFile("/proc/loadavg")
+		if err != nil {
+			return true
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return true
+		}
+		load, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || load < float64(runtime.NumCPU()) {
+			return true
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+func (c *TranscodeCache) transcode(ch *Channel, path string) error {
+	entry, err := c.entryDir(ch, path)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Transcoding to cache: %s\n", path)
+	tmpDir := entry + ".tmp"
+	os.RemoveAll(tmpDir)
+	os.MkdirAll(filepath.Dir(entry), os.ModePerm)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	args := append([]string{"-n", "19", "ffmpeg"}, ch.encodeArgs(path, encodeCache, tmpDir, c.threads())...)
+	cmd := ffmpegCommand(c.ctx, "nice", args...)
+	stderr := &stderrTail{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(tmpDir)
+		return classifyFailure(err, stderr.String())
+	}
+
+	os.RemoveAll(entry)
+	if err := os.Rename(tmpDir, entry); err != nil {
+		return err
+	}
+	log.Printf("Cached %s\n", path)
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Channel is one independent stream with its own library, schedule,
+// overlay, encoder settings and output folder
+type Channel struct {
+	name      string
+	config    ChannelConfig
+	outputDir string
+	workDir   string
+	profile   EncodingProfile
+
+	mutex sync.Mutex
+	// lifecycleLock serializes start and stop, which wait on ffmpeg
+	// without holding mutex
+	lifecycleLock sync.Mutex
+
+	videoQueue    []string
+	currentIndex  int
+	playingIndex  int
+	currentCancel context.CancelFunc
+	stopStream    context.CancelFunc
+	isStreaming   bool
+	streamingDone chan bool
+	pendingClips  []string
+	programCount  int
+	clipIndex     int
+	nowPlaying    Program
+	lastPick      time.Time
+	failures      FailureSummary
+	hold          bool
+	onFallback    bool
+	// onAir is set while nowPlaying is being published, not the clips
+	// after it
+	onAir bool
+	// quarantineSkips counts quarantined items skipped in a row
+	quarantineSkips int
+
+	// On-demand state: who is watching, and where an idled channel left off
+	viewers     map[string]time.Time
+	lastRequest time.Time
+	parked      bool
+	parkedIndex int
+	resume      *resumePoint
+	slate       []*SegmentSet
+
+	playlist           *LivePlaylist
+	audioRenditions    []*audioRendition
+	subtitleRenditions []*subtitleRendition
+	// periods numbers the programs across all playlists, for DASH
+	periods int
+}
+
+var (
+	channels     = map[string]*Channel{}
+	channelOrder []*Channel
+)
+
+func NewChannel(cfg ChannelConfig) *Channel {
+	ch := &Channel{
+		name:         cfg.Name,
+		config:       cfg,
+		outputDir:    filepath.Join(config.OutputDir, cfg.Name),
+		workDir:      filepath.Join(config.WorkDir, cfg.Name),
+		playingIndex: -1,
+		viewers:      map[string]time.Time{},
+	}
+	// channelConfigs made sure the profile exists
+	ch.profile, _ = lookupProfile(cfg.Profile)
+
+	// Create static and work folders
+	os.MkdirAll(ch.outputDir, os.ModePerm)
+	os.MkdirAll(ch.workDir, os.ModePerm)
+
+	// The server owns the live playlist, ffmpeg only produces segments
+	ch.playlist = ch.newPlaylist("stream.m3u8")
+	ch.audioRenditions = ch.newAudioRenditions()
+	ch.subtitleRenditions = ch.newSubtitleRenditions()
+	ch.resetOutputs()
+	return ch
+}
+
+func (ch *Channel) newPlaylist(name string) *LivePlaylist {
+	return NewLivePlaylist(ch.outputDir, name, ch.config.WindowSize, ch.config.RetainSegments, ch.config.SegmentTime)
+}
+
+// channelHandler is an HTTP handler bound to the channel named in the path
+type channelHandler func(ch *Channel, w http.ResponseWriter, r *http.Request)
+
+// withChannel resolves {name} from the path. Routes without it act on the
+// first channel, which keeps the single channel URLs working.
+func withChannel(h channelHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ch := channelOrder[0]
+		if name := r.PathValue("name"); name != "" {
+			ch = channels[name]
+		}
+		if ch == nil {
+			http.NotFound(w, r)
+			return
+		}
+		h(ch, w, r)
+	}
+}
+
+func skipVideoHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if ch.currentCancel != nil {
+		// Stop the current program, the loop moves on to the next one
+		ch.currentCancel()
+		fmt.Fprintf(w, "Skipped to the next video")
+	} else {
+		fmt.Fprintf(w, "No video is currently playing")
+	}
+}
+
+func (ch *Channel) startStreamProcess(ctx context.Context) {
+	ch.catchUp(time.Now())
+	for ctx.Err() == nil {
+		ch.processNextVideo(ctx)
+	}
+	close(ch.streamingDone)
+}
+
+func (ch *Channel) processNextVideo(streamCtx context.Context) {
+	ch.mutex.Lock()
+	if ch.hold {
+		ch.mutex.Unlock()
+		ch.playFallback(streamCtx, func() bool {
+			ch.mutex.Lock()
+			defer ch.mutex.Unlock()
+			return !ch.hold
+		})
+		return
+	}
+
+	if len(ch.videoQueue) == 0 {
+		ch.refillQueue()
+	}
+
+	if len(ch.videoQueue) == 0 {
+		ch.mutex.Unlock()
+		log.Printf("[%s] No videos found in the queue\n", ch.name)
+		ch.playFallbackFor(streamCtx, fallbackRecheck)
+		return
+	}
+
+	// A due programming slot takes precedence over the queue
+	now := time.Now()
+	if ch.lastPick.IsZero() {
+		ch.lastPick = now
+	}
+	program := Program{Start: now}
+	offset := 0.0
+	if ch.resume != nil {
+		// Pick up where the channel idled or was put on hold
+		program = ch.resume.program
+		offset = ch.resume.offset
+		program.Start = now.Add(-time.Duration(offset * float64(time.Second)))
+		ch.playingIndex = ch.resume.index
+		ch.resume = nil
+	} else if slot := dueSlot(ch.config.Programming, ch.lastPick, now); slot != nil && !quarantine.Has(filepath.Join(ch.config.VideoFolder, slot.File)) {
+		program.File = slot.File
+		program.Title = slot.Title
+		program.Scheduled = true
+		ch.playingIndex = -1
+	} else {
+		if ch.currentIndex >= len(ch.videoQueue) {
+			ch.currentIndex = 0
+		}
+
+		// The watcher may not have noticed a deleted file yet
+		if _, err := os.Stat(filepath.Join(ch.config.VideoFolder, ch.videoQueue[ch.currentIndex])); err != nil {
+			log.Printf("[%s] Dropping missing video: %s\n", ch.name, ch.videoQueue[ch.currentIndex])
+			ch.removeQueueItem(ch.currentIndex)
+			ch.mutex.Unlock()
+			return
+		}
+
+		// Quarantined items stay queued so releasing them brings them back
+		if quarantine.Has(filepath.Join(ch.config.VideoFolder, ch.videoQueue[ch.currentIndex])) {
+			ch.currentIndex = (ch.currentIndex + 1) % len(ch.videoQueue)
+			ch.quarantineSkips++
+			allQuarantined := ch.quarantineSkips >= len(ch.videoQueue)
+			if allQuarantined {
+				ch.quarantineSkips = 0
+			}
+			ch.mutex.Unlock()
+
+			if allQuarantined {
+				log.Printf("[%s] Every queued video is quarantined\n", ch.name)
+				ch.playFallbackFor(streamCtx, fallbackRecheck)
+			}
+			return
+		}
+		ch.quarantineSkips = 0
+		program.File = ch.videoQueue[ch.currentIndex]
+		ch.playingIndex = ch.currentIndex
+		ch.currentIndex = (ch.currentIndex + 1) % len(ch.videoQueue)
+	}
+	if program.Title == "" {
+		program.Title = programTitle(program.File)
+	}
+	ch.lastPick = program.Start
+	videoFile := program.File
+	ch.programCount++
+
+	// Splice a clip after every N programs when configured
+	if ch.config.ClipEvery > 0 && ch.programCount%ch.config.ClipEvery == 0 {
+		if clips := ch.listClips(); len(clips) > 0 {
+			ch.pendingClips = append(ch.pendingClips, clips[ch.clipIndex%len(clips)])
+			ch.clipIndex++
+		}
+	}
+	ch.mutex.Unlock()
+
+	videoPath := filepath.Join(ch.config.VideoFolder, videoFile)
+	log.Printf("[%s] Processing video: %s\n", ch.name, videoPath)
+
+	duration := ch.itemDuration(videoFile)
+	program.Stop = program.Start.Add(time.Duration(duration * float64(time.Second)))
+	ch.mutex.Lock()
+	ch.nowPlaying = program
+	ch.mutex.Unlock()
+
+	ctx := ch.beginProgram(streamCtx)
+	out := ch.beginOutput(videoPath)
+	ch.mutex.Lock()
+	ch.onAir = true
+	ch.mutex.Unlock()
+
+	// Publish the cached rendition, fall back to encoding live without one
+	var err error
+	if sets, ok := cache.Lookup(ch, videoPath); ok {
+		log.Printf("[%s] Publishing cached rendition of %s\n", ch.name, videoFile)
+		sets, starts := skipSegments(sets, offset)
+		out.seek(starts)
+		err = publishSegmentSets(ctx, out, sets)
+	} else {
+		cache.Enqueue(ch, videoPath)
+		err = ch.publishEncoder(ctx, out, videoPath, offset)
+	}
+	ch.mutex.Lock()
+	ch.onAir = false
+	ch.mutex.Unlock()
+	if err != nil {
+		// Check if the process was killed intentionally
+		if ctx.Err() != nil {
+			log.Printf("[%s] Video was skipped\n", ch.name)
+		} else if delay := ch.recordFailure(videoPath, err); delay > 0 {
+			log.Printf("[%s] Backing off for %s\n", ch.name, delay)
+			select {
+			case <-streamCtx.Done():
+			case <-time.After(delay):
+			}
+		}
+	} else {
+		ch.recordSuccess(videoPath)
+	}
+
+	ch.playPendingClips(streamCtx)
+}
+
+// beginProgram returns a context that is cancelled when the program is
+// skipped or streaming stops
+func (ch *Channel) beginProgram(streamCtx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(streamCtx)
+	ch.mutex.Lock()
+	ch.currentCancel = cancel
+	ch.mutex.Unlock()
+	return ctx
+}
+
+// playPendingClips splices the queued clips. A hold cuts to the slate
+// right away, the clips left stay queued until after the next program.
+func (ch *Channel) playPendingClips(streamCtx context.Context) {
+	for {
+		ch.mutex.Lock()
+		if len(ch.pendingClips) == 0 || ch.hold || streamCtx.Err() != nil {
+			ch.mutex.Unlock()
+			return
+		}
+		name := ch.pendingClips[0]
+		ch.pendingClips = ch.pendingClips[1:]
+		ch.mutex.Unlock()
+
+		sets, err := ch.loadClip(name)
+		if err != nil {
+			log.Printf("[%s] Error loading clip %s: %v\n", ch.name, name, err)
+			continue
+		}
+
+		log.Printf("[%s] Splicing clip: %s\n", ch.name, name)
+		ctx := ch.beginProgram(streamCtx)
+		if err := publishSegmentSets(ctx, ch.beginOutput(""), sets); err != nil && ctx.Err() == nil {
+			log.Printf("[%s] Error splicing clip %s: %v\n", ch.name, name, err)
+		}
+	}
+}
+
+func spliceClipHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("clip")
+	if _, err := ch.loadClip(name); name == "" || err != nil {
+		http.Error(w, "Unknown clip", http.StatusNotFound)
+		return
+	}
+
+	ch.mutex.Lock()
+	ch.pendingClips = append(ch.pendingClips, name)
+	ch.mutex.Unlock()
+
+	fmt.Fprintf(w, "Clip %s will be spliced after the current program", name)
+}
+
+// refillQueue rebuilds the queue from the library, the caller must hold mutex
+func (ch *Channel) refillQueue() {
+	library, err := listLibrary(ch.config.VideoFolder)
+	if err != nil {
+		log.Printf("[%s] Error reading video folder: %v\n", ch.name, err)
+		ch.videoQueue = []string{}
+		return
+	}
+
+	// Files still being copied join once the library watcher sees them
+	// settle, or with the next refill when it doesn't poll
+	ch.videoQueue = []string{}
+	now := time.Now()
+	for name, state := range library {
+		if !state.settled(now) {
+			log.Printf("[%s] Waiting for %s to finish copying\n", ch.name, name)
+			continue
+		}
+		ch.videoQueue = append(ch.videoQueue, name)
+	}
+	sort.Strings(ch.videoQueue)
+	if ch.config.QueueOrder == orderShuffle {
+		rand.Shuffle(len(ch.videoQueue), func(i, j int) {
+			ch.videoQueue[i], ch.videoQueue[j] = ch.videoQueue[j], ch.videoQueue[i]
+		})
+	}
+
+	// Queue the library for pre-transcoding in playout order
+	for _, videoFile := range ch.videoQueue {
+		cache.Enqueue(ch, filepath.Join(ch.config.VideoFolder, videoFile))
+		thumbnails.Enqueue(filepath.Join(ch.config.VideoFolder, videoFile))
+	}
+	for _, slot := range ch.config.Programming {
+		thumbnails.Enqueue(filepath.Join(ch.config.VideoFolder, slot.File))
+	}
+
+	log.Printf("[%s] Video queue refilled with %d videos\n", ch.name, len(ch.videoQueue))
+}
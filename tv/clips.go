@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// prepareClips encodes every raw video in the clips folder into its own
+// segment set once, so ads and idents can later be spliced into the live
+// playlist without touching the encoder. Each channel keeps its own sets
+// since segment length and audio layout may differ.
+func (ch *Channel) prepareClips(ctx context.Context) {
+	files, err := os.ReadDir(config.ClipsFolder)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".mp4") {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		clipDir := filepath.Join(ch.clipsDir(), name)
+		// A clip is ready once its last track playlist is written
+		playlists := ch.trackPlaylists(clipDir)
+		if _, err := os.Stat(playlists[len(playlists)-1]); err == nil {
+			continue
+		}
+
+		log.Printf("[%s] Preparing clip: %s\n", ch.name, file.Name())
+		tmpDir := clipDir + ".tmp"
+		os.RemoveAll(tmpDir)
+		os.MkdirAll(tmpDir, os.ModePerm)
+
+		cmd := ffmpegCommand(ctx, "nice", append([]string{"ffmpeg"}, ch.encodeArgs(filepath.Join(config.ClipsFolder, file.Name()), encodeClip, tmpDir, 0)...)...)
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				os.RemoveAll(tmpDir)
+				return
+			}
+			log.Printf("[%s] Error preparing clip %s: %v\n", ch.name, file.Name(), err)
+			os.RemoveAll(tmpDir)
+			continue
+		}
+		os.RemoveAll(clipDir)
+		os.Rename(tmpDir, clipDir)
+	}
+}
+
+// clipsDir is where the prepared clips of the channel are kept. Like the
+// transcode cache it is keyed on the encode settings, so clips are
+// prepared again after they change instead of splicing the old ones in.
+func (ch *Channel) clipsDir() string {
+	return filepath.Join(config.ClipsFolder, ch.name, ch.cacheProfile())
+}
+
+// listClips returns the names of all clips prepared for the channel
+func (ch *Channel) listClips() []string {
+	matches, _ := filepath.Glob(filepath.Join(ch.clipsDir(), "*", "index*.m3u8"))
+
+	clips := []string{}
+	seen := map[string]bool{}
+	for _, m := range matches {
+		dir := filepath.Dir(m)
+		if strings.HasSuffix(dir, ".tmp") || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		clips = append(clips, filepath.Base(dir))
+	}
+	sort.Strings(clips)
+	return clips
+}
+
+func (ch *Channel) loadClip(name string) ([]*SegmentSet, error) {
+	return ch.readTrackSets(filepath.Join(ch.clipsDir(), filepath.Base(name)))
+}
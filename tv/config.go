@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ChannelConfig holds everything that can differ between channels
+type ChannelConfig struct {
+	Name           string         `json:"name"`
+	ChannelID      string         `json:"channelId"`
+	ChannelName    string         `json:"channelName"`
+	VideoFolder    string         `json:"videoFolder"`
+	Overlay        string         `json:"overlay"`
+	SegmentTime    int            `json:"segmentTime"`
+	WindowSize     int            `json:"windowSize"`
+	RetainSegments int            `json:"retainSegments"`
+	ClipEvery      int            `json:"clipEvery"`
+	Programming    []Slot         `json:"programming"`
+	Subtitles      SubtitleConfig `json:"subtitles"`
+	Audio          AudioConfig    `json:"audio"`
+	QueueOrder     string         `json:"queueOrder"`
+	// Profile names the entry of Profiles every encode of the channel uses
+	Profile  string         `json:"profile"`
+	Fallback FallbackConfig `json:"fallback"`
+	// DASH publishes manifest.mpd next to the HLS playlists, both list
+	// the same CMAF segments
+	DASH bool `json:"dash"`
+	// OnDemand starts playout with the first viewer and stops it again
+	// once nobody watched for IdleTimeout seconds
+	OnDemand    bool `json:"onDemand"`
+	IdleTimeout int  `json:"idleTimeoutSeconds"`
+}
+
+// Config is the server config. The embedded channel settings describe
+// the only channel when Channels is empty, and are the defaults every
+// entry of Channels starts from otherwise.
+type Config struct {
+	ChannelConfig
+	OutputDir      string  `json:"outputDir"`
+	WorkDir        string  `json:"workDir"`
+	ClipsFolder    string  `json:"clipsFolder"`
+	CacheFolder    string  `json:"cacheFolder"`
+	CacheWorkers   int     `json:"cacheWorkers"`
+	CacheCPUBudget float64 `json:"cacheCpuBudget"`
+	// Poster frames and seek preview sprites, one tile every
+	// ThumbnailInterval seconds
+	ThumbnailFolder   string `json:"thumbnailFolder"`
+	ThumbnailInterval int    `json:"thumbnailIntervalSeconds"`
+	GuideHours        int    `json:"guideHours"`
+	ClearOnStop       bool   `json:"clearOnStop"`
+	LibraryPoll       int    `json:"libraryPollSeconds"`
+	// Sources failing QuarantineAfter times in a row are quarantined
+	QuarantineFile  string                     `json:"quarantineFile"`
+	QuarantineAfter int                        `json:"quarantineAfter"`
+	Profiles        map[string]EncodingProfile `json:"profiles"`
+	Auth            AuthConfig                 `json:"auth"`
+	Channels        []json.RawMessage          `json:"channels"`
+}
+
+const configFile = "config.json"
+
+var config = Config{
+	ChannelConfig: ChannelConfig{
+		Name:           "main",
+		ChannelID:      "usual.tv",
+		ChannelName:    "USUAL CHANNEL",
+		VideoFolder:    "../video",
+		Overlay:        "пися палыч тв",
+		SegmentTime:    3,
+		WindowSize:     10,
+		RetainSegments: 10,
+		ClipEvery:      0,
+		Subtitles:      SubtitleConfig{Mode: subtitlesOff},
+		QueueOrder:     orderName,
+		Profile:        defaultProfile,
+		Fallback:       FallbackConfig{Text: "Please stand by"},
+		IdleTimeout:    120,
+	},
+	OutputDir:         "static",
+	WorkDir:           "work",
+	ClipsFolder:       "clips",
+	CacheFolder:       "cache",
+	CacheWorkers:      1,
+	CacheCPUBudget:    0.5,
+	ThumbnailFolder:   "thumbnails",
+	ThumbnailInterval: 10,
+	GuideHours:        24,
+	LibraryPoll:       10,
+	QuarantineFile:    "quarantine.json",
+	QuarantineAfter:   3,
+	Profiles:          map[string]EncodingProfile{defaultProfile: baseProfile},
+	Auth:              AuthConfig{AuditLog: "audit.log"},
+}
+
+func loadConfig() error {
+	// The config file is optional, defaults are used when it is missing
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Unmarshal on top of the defaults so missing keys keep their values
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	return nil
+}
+
+// channelConfigs returns the config of every channel, each one filled in
+// from the top-level settings first
+func channelConfigs() ([]ChannelConfig, error) {
+	if len(config.Channels) == 0 {
+		if _, err := lookupProfile(config.Profile); err != nil {
+			return nil, err
+		}
+		return []ChannelConfig{config.ChannelConfig}, nil
+	}
+
+	configs := []ChannelConfig{}
+	for i, raw := range config.Channels {
+		cfg := config.ChannelConfig
+		cfg.Name = ""
+
+		// Copy the slices, decoding into them would reuse their arrays
+		cfg.Programming = append([]Slot(nil), cfg.Programming...)
+		cfg.Subtitles.Languages = append([]string(nil), cfg.Subtitles.Languages...)
+		cfg.Audio.Languages = append([]string(nil), cfg.Audio.Languages...)
+		cfg.Audio.Overrides = append([]AudioOverride(nil), cfg.Audio.Overrides...)
+
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal channel %d: %w", i, err)
+		}
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("channel %d has no name", i)
+		}
+		if _, err := lookupProfile(cfg.Profile); err != nil {
+			return nil, fmt.Errorf("channel %s: %w", cfg.Name, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dashManifest is the DASH manifest next to master.m3u8
+const dashManifest = "manifest.mpd"
+
+// dashTimescale is the SegmentTimeline resolution, milliseconds
+const dashTimescale = 1000
+
+// dashTrack is one adaptation set of the manifest
+type dashTrack struct {
+	id       string
+	audio    bool
+	language string
+	segments []Segment
+}
+
+// writeDASHManifest renders the live DASH manifest from the segments in
+// the HLS windows. Periods are the programs and start at the same wall
+// clock times as the EXT-X-PROGRAM-DATE-TIME tags, so both manifests put
+// every segment at the same moment.
+func (ch *Channel) writeDASHManifest() error {
+	video, ended := ch.playlist.Snapshot()
+	tracks := []dashTrack{{id: "video", segments: video}}
+	for _, r := range ch.audioRenditions {
+		segments, _ := r.playlist.Snapshot()
+		tracks = append(tracks, dashTrack{id: "audio_" + r.language, audio: true, language: r.language, segments: segments})
+	}
+
+	// Periods come from the video track, audio follows by period ID
+	periods := []*Period{}
+	for _, seg := range video {
+		if seg.Period != nil && (len(periods) == 0 || periods[len(periods)-1].ID != seg.Period.ID) {
+			periods = append(periods, seg.Period)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	segmentTime := float64(ch.config.SegmentTime)
+	origin := ch.playlist.Epoch()
+	if ended {
+		// What is left plays as a recording from the first period on
+		total := 0.0
+		if len(periods) > 0 {
+			origin = periods[0].Start
+			last := video[len(video)-1]
+			total = last.Start.Sub(origin).Seconds() + last.Duration
+		}
+		fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="static" mediaPresentationDuration="%s" minBufferTime="%s">`+"\n",
+			formatDASHDuration(total), formatDASHDuration(2*segmentTime))
+	} else {
+		fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic" availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">`+"\n",
+			origin.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339),
+			formatDASHDuration(segmentTime), formatDASHDuration(2*segmentTime),
+			formatDASHDuration(float64(ch.config.WindowSize)*segmentTime), formatDASHDuration(3*segmentTime))
+	}
+
+	for _, period := range periods {
+		fmt.Fprintf(&b, `  <Period id="%d" start="%s">`+"\n", period.ID, formatDASHDuration(period.Start.Sub(origin).Seconds()))
+		for i, track := range tracks {
+			writeDASHAdaptationSet(&b, ch.profile, i, track, period.ID)
+		}
+		b.WriteString("  </Period>\n")
+	}
+	b.WriteString("</MPD>\n")
+
+	path := filepath.Join(ch.outputDir, dashManifest)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeDASHAdaptationSet lists the segments of track in one period
+func writeDASHAdaptationSet(b *strings.Builder, p EncodingProfile, id int, track dashTrack, period int) {
+	segments := []Segment{}
+	for _, seg := range track.segments {
+		if seg.Period != nil && seg.Period.ID == period {
+			segments = append(segments, seg)
+		}
+	}
+	if len(segments) == 0 {
+		return
+	}
+
+	if track.audio {
+		fmt.Fprintf(b, `    <AdaptationSet id="%d" contentType="audio" mimeType="audio/mp4" lang="%s" segmentAlignment="true" startWithSAP="1">`+"\n", id, track.language)
+		fmt.Fprintf(b, `      <Representation id="%s" codecs="%s" bandwidth="%d" audioSamplingRate="48000">`+"\n", track.id, p.audioCodec(), p.AudioBitrateKbps*1000)
+		b.WriteString(`        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="2"/>` + "\n")
+	} else {
+		fmt.Fprintf(b, `    <AdaptationSet id="%d" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">`+"\n", id)
+		fmt.Fprintf(b, `      <Representation id="%s" codecs="%s" bandwidth="%d" width="%d" height="%d">`+"\n",
+			track.id, p.videoCodec(), p.bandwidth()-p.AudioBitrateKbps*1000, p.Width, p.Height)
+	}
+
+	// The first media time of the program maps to the period start
+	fmt.Fprintf(b, `        <SegmentList timescale="%d" presentationTimeOffset="%d">`+"\n", dashTimescale, dashTicks(segments[0].Period.MediaTime))
+	fmt.Fprintf(b, `          <Initialization sourceURL="%s"/>`+"\n", segments[0].Init)
+	b.WriteString("          <SegmentTimeline>\n")
+	for _, seg := range segments {
+		t := dashTicks(seg.MediaTime)
+		fmt.Fprintf(b, `            <S t="%d" d="%d"/>`+"\n", t, dashTicks(seg.MediaTime+seg.Duration)-t)
+	}
+	b.WriteString("          </SegmentTimeline>\n")
+	for _, seg := range segments {
+		fmt.Fprintf(b, `          <SegmentURL media="%s"/>`+"\n", seg.Name)
+	}
+	b.WriteString("        </SegmentList>\n")
+	b.WriteString("      </Representation>\n")
+	b.WriteString("    </AdaptationSet>\n")
+}
+
+func dashTicks(seconds float64) int64 {
+	return int64(math.Round(seconds * dashTimescale))
+}
+
+// formatDASHDuration formats seconds as an xs:duration
+func formatDASHDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
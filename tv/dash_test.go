@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testMPD struct {
+	Periods []struct {
+		ID             string `xml:"id,attr"`
+		AdaptationSets []struct {
+			ContentType string `xml:"contentType,attr"`
+			Segments    []struct {
+				Media string `xml:"media,attr"`
+			} `xml:"Representation>SegmentList>SegmentURL"`
+		} `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+func TestDASHTracksSharePeriods(t *testing.T) {
+	dir := t.TempDir()
+	ch := &Channel{
+		name:      "test",
+		outputDir: dir,
+		workDir:   dir,
+		profile:   baseProfile,
+		config:    ChannelConfig{SegmentTime: 4, WindowSize: 10, RetainSegments: 10, DASH: true},
+	}
+	ch.playlist = ch.newPlaylist("index.m3u8")
+	ch.audioRenditions = []*audioRendition{{language: "eng", playlist: ch.newPlaylist("audio_eng.m3u8")}}
+	ch.subtitleRenditions = []*subtitleRendition{{language: "eng", playlist: ch.newPlaylist("subs_eng.m3u8"), workDir: dir}}
+
+	segment := func(name string) string {
+		path := filepath.Join(dir, "src_"+name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// The first program was cut short after its video segment, before
+	// the audio one, which must not shift the audio into the wrong period
+	out := ch.beginOutput("")
+	if err := out.append(0, segment("a.m4s"), 4, true); err != nil {
+		t.Fatal(err)
+	}
+	out = ch.beginOutput("")
+	if err := out.append(0, segment("b.m4s"), 4, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.append(1, segment("b_audio.m4s"), 4, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, dashManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mpd testMPD
+	if err := xml.Unmarshal(data, &mpd); err != nil {
+		t.Fatal(err)
+	}
+	if len(mpd.Periods) != 2 {
+		t.Fatalf("%d periods, want 2:\n%s", len(mpd.Periods), data)
+	}
+	if sets := mpd.Periods[0].AdaptationSets; len(sets) != 1 || sets[0].ContentType != "video" {
+		t.Errorf("first period has %d adaptation sets, want only the video:\n%s", len(sets), data)
+	}
+	second := mpd.Periods[1]
+	if len(second.AdaptationSets) != 2 || second.AdaptationSets[1].ContentType != "audio" ||
+		len(second.AdaptationSets[1].Segments) != 1 || second.AdaptationSets[1].Segments[0].Media != "audio_eng0.m4s" {
+		t.Errorf("second period doesn't carry its audio segment:\n%s", data)
+	}
+
+	// Subtitles aren't in the manifest but follow the same periods
+	video, _ := ch.playlist.Snapshot()
+	subs, _ := ch.subtitleRenditions[0].playlist.Snapshot()
+	if len(subs) != len(video) {
+		t.Fatalf("%d subtitle segments for %d video segments", len(subs), len(video))
+	}
+	for i := range video {
+		if subs[i].Period.ID != video[i].Period.ID {
+			t.Errorf("subtitle segment %d is in period %d, video in %d", i, subs[i].Period.ID, video[i].Period.ID)
+		}
+	}
+}
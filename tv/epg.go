@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// xmltvTime is the timestamp layout XMLTV clients expect
+const xmltvTime = "20060102150405 -0700"
+
+type xmltvDocument struct {
+	XMLName    xml.Name         `xml:"tv"`
+	Generator  string           `xml:"generator-info-name,attr"`
+	Channels   []xmltvChannel   `xml:"channel"`
+	Programmes []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	ID          string `xml:"id,attr"`
+	DisplayName string `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+	Start   string     `xml:"start,attr"`
+	Stop    string     `xml:"stop,attr"`
+	Channel string     `xml:"channel,attr"`
+	Title   string     `xml:"title"`
+	Icon    *xmltvIcon `xml:"icon"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+func guideHorizon() time.Time {
+	return time.Now().Add(time.Duration(config.GuideHours) * time.Hour)
+}
+
+// channelGuide is the JSON guide of one channel
+type channelGuide struct {
+	Channel  string    `json:"channel"`
+	Name     string    `json:"name"`
+	Programs []Program `json:"programs"`
+}
+
+func (ch *Channel) guide() channelGuide {
+	programs := ch.projectSchedule(guideHorizon())
+	for i := range programs {
+		programs[i].Poster, programs[i].Preview = ch.thumbnailURLs(programs[i].File)
+	}
+	return channelGuide{
+		Channel:  ch.config.ChannelID,
+		Name:     ch.config.ChannelName,
+		Programs: programs,
+	}
+}
+
+func epgJSONHandler(w http.ResponseWriter, r *http.Request) {
+	guides := []channelGuide{}
+	for _, ch := range channelOrder {
+		guides = append(guides, ch.guide())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(guides)
+}
+
+func channelEPGHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ch.guide())
+}
+
+func epgXMLTVHandler(w http.ResponseWriter, r *http.Request) {
+	doc := xmltvDocument{Generator: "tv"}
+	base := baseURL(r)
+	horizon := guideHorizon()
+	for _, ch := range channelOrder {
+		doc.Channels = append(doc.Channels, xmltvChannel{ID: ch.config.ChannelID, DisplayName: ch.config.ChannelName})
+		for _, program := range ch.projectSchedule(horizon) {
+			programme := xmltvProgramme{
+				Start:   program.Start.Format(xmltvTime),
+				Stop:    program.Stop.Format(xmltvTime),
+				Channel: ch.config.ChannelID,
+				Title:   program.Title,
+			}
+			// Guide clients fetch icons themselves, so they need the full address
+			if poster, _ := ch.thumbnailURLs(program.File); poster != "" {
+				programme.Icon = &xmltvIcon{Src: base + poster}
+			}
+			doc.Programmes = append(doc.Programmes, programme)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+}
+
+// baseURL rebuilds the address the client used to reach the server, so
+// the generated lists work from other machines on the network
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func channelListHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	fmt.Fprintf(w, "#EXTM3U url-tvg=\"%s/epg.xml\" x-tvg-url=\"%s/epg.xml\"\n", base, base)
+	for _, ch := range channelOrder {
+		fmt.Fprintf(w, "#EXTINF:-1 tvg-id=\"%s\" tvg-name=\"%s\",%s\n", ch.config.ChannelID, ch.config.ChannelName, ch.config.ChannelName)
+		fmt.Fprintf(w, "%s/channels/%s/master.m3u8\n", base, ch.name)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FallbackConfig is the slate shown when there is nothing to play or an
+// operator put the channel on hold. Without an image or clip it is a
+// black picture with the text.
+type FallbackConfig struct {
+	Image string `json:"image"`
+	// Clip loops, it replaces the image when both are set
+	Clip string `json:"clip"`
+	// Audio loops under the slate, silence when empty and the clip has none
+	Audio string `json:"audio"`
+	Text  string `json:"text"`
+}
+
+// fallbackRecheck is how often the slate for an empty or fully quarantined
+// queue gives way to check for something to play
+const fallbackRecheck = 30 * time.Second
+
+// fallbackArgs builds the endless live encode of the fallback slate with
+// the same track layout as every other encode of the channel
+func (ch *Channel) fallbackArgs(outputDir string) []string {
+	fb := ch.config.Fallback
+
+	args := []string{"-nostdin", "-y", "-re"}
+	switch {
+	case fb.Clip != "":
+		args = append(args, "-stream_loop", "-1", "-i", fb.Clip)
+	case fb.Image != "":
+		args = append(args, "-loop", "1", "-framerate", "25", "-i", fb.Image)
+	default:
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%dx%d:r=25", ch.profile.Width, ch.profile.Height))
+	}
+
+	clipAudio := false
+	if fb.Clip != "" {
+		streams, _ := probeStreams(fb.Clip, "a")
+		clipAudio = len(streams) > 0
+	}
+
+	audio := "1:a:0"
+	switch {
+	case fb.Audio != "":
+		args = append(args, "-re", "-stream_loop", "-1", "-i", fb.Audio)
+	case clipAudio:
+		audio = "0:a:0"
+	default:
+		args = append(args, "-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo")
+	}
+
+	args = append(args, "-map", "0:v:0")
+	for i := 0; i < ch.audioTrackCount(); i++ {
+		args = append(args, "-map", audio)
+	}
+
+	filter := "[in]" + ch.profile.scaleFilter() + ",fps=25,format=yuv420p"
+	filter += ch.overlayFilter() + clockFilter
+	if fb.Text != "" {
+		filter += ",drawtext=fontsize=22:fontcolor=white:expansion=none:text=" + escapeFilterValue(fb.Text) + ":x=(w-tw)/2:y=(h-th)/2"
+	}
+	filter += "[out]"
+
+	args = append(args, "-vf", filter)
+	args = append(args, ch.videoCodecArgs(25)...)
+	return append(args, ch.hlsOutputArgs(encodeLive, outputDir, 0)...)
+}
+
+// playFallback publishes the fallback slate until done reports true,
+// streaming stops or the slate is skipped
+func (ch *Channel) playFallback(streamCtx context.Context, done func() bool) {
+	ctx := ch.beginProgram(streamCtx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch.mutex.Lock()
+	ch.onFallback = true
+	ch.mutex.Unlock()
+	defer func() {
+		ch.mutex.Lock()
+		ch.onFallback = false
+		ch.mutex.Unlock()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if done() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	log.Printf("[%s] Showing fallback slate\n", ch.name)
+	err := ch.publishFFmpeg(ctx, ch.beginOutput(""), ch.fallbackArgs(ch.liveDir()))
+	if err != nil && ctx.Err() == nil {
+		log.Printf("[%s] Error showing fallback slate: %v\n", ch.name, err)
+		// Don't spin when the slate itself is broken
+		select {
+		case <-streamCtx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// playFallbackFor shows the slate for up to d, ending early when the
+// library watcher adds something to the queue
+func (ch *Channel) playFallbackFor(streamCtx context.Context, d time.Duration) {
+	until := time.Now().Add(d)
+	ch.mutex.Lock()
+	queued := len(ch.videoQueue)
+	ch.mutex.Unlock()
+
+	ch.playFallback(streamCtx, func() bool {
+		ch.mutex.Lock()
+		defer ch.mutex.Unlock()
+		return time.Now().After(until) || len(ch.videoQueue) > queued
+	})
+}
+
+// holdProgram cuts to the fallback slate. The interrupted program resumes
+// where it was once the hold is released. The caller must hold ch.mutex.
+func (ch *Channel) holdProgram() {
+	if ch.hold {
+		return
+	}
+	ch.hold = true
+
+	if ch.currentCancel == nil || ch.onFallback {
+		return
+	}
+	// A clip is cut short without a resume point, the program before it
+	// already ended
+	if ch.onAir {
+		ch.resume = &resumePoint{
+			program: ch.nowPlaying,
+			index:   ch.playingIndex,
+			offset:  time.Since(ch.nowPlaying.Start).Seconds(),
+		}
+	}
+	ch.currentCancel()
+}
+
+func holdHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	ch.holdProgram()
+	ch.mutex.Unlock()
+
+	log.Printf("[%s] Channel on hold\n", ch.name)
+	ch.writeQueue(w)
+}
+
+func releaseHoldHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	ch.hold = false
+	ch.mutex.Unlock()
+
+	log.Printf("[%s] Hold released\n", ch.name)
+	ch.writeQueue(w)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHoldSkipsPendingClips(t *testing.T) {
+	ch := &Channel{name: "test", hold: true, pendingClips: []string{"ident", "ad"}}
+
+	// Loading a clip would fail without a clips folder, so a loop that
+	// got past the hold check would drop both clips
+	ch.playPendingClips(context.Background())
+	if !reflect.DeepEqual(ch.pendingClips, []string{"ident", "ad"}) {
+		t.Fatalf("pending clips are %v after a hold, want both still queued", ch.pendingClips)
+	}
+}
+
+func TestHoldDuringClipHasNoResumePoint(t *testing.T) {
+	cancelled := false
+	ch := &Channel{
+		nowPlaying:    Program{File: "ended.mp4", Start: time.Now().Add(-time.Hour)},
+		currentCancel: func() { cancelled = true },
+	}
+
+	ch.holdProgram()
+	if !ch.hold || !cancelled {
+		t.Fatalf("hold %v, clip cancelled %v, want both", ch.hold, cancelled)
+	}
+	if ch.resume != nil {
+		t.Fatalf("hold during a clip resumes %s, which already ended", ch.resume.program.File)
+	}
+}
+
+func TestHoldRecordsResumePoint(t *testing.T) {
+	ch := &Channel{
+		nowPlaying:    Program{File: "movie.mp4", Start: time.Now().Add(-time.Minute)},
+		playingIndex:  3,
+		onAir:         true,
+		currentCancel: func() {},
+	}
+
+	ch.holdProgram()
+	if ch.resume == nil || ch.resume.program.File != "movie.mp4" || ch.resume.index != 3 {
+		t.Fatalf("resume point is %+v, want movie.mp4 at index 3", ch.resume)
+	}
+	if ch.resume.offset < 59 || ch.resume.offset > 61 {
+		t.Errorf("resumes at %.0fs, want 60s", ch.resume.offset)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "strings"
+
+// languageCodes maps ISO 639-2 codes found in container tags to the
+// two-letter codes used in config and HLS renditions
+var languageCodes = map[string]string{
+	"eng": "en",
+	"rus": "ru",
+	"ukr": "uk",
+	"ger": "de",
+	"deu": "de",
+	"fre": "fr",
+	"fra": "fr",
+	"spa": "es",
+	"ita": "it",
+	"por": "pt",
+	"jpn": "ja",
+	"chi": "zh",
+	"zho": "zh",
+	"kor": "ko",
+	"pol": "pl",
+	"dut": "nl",
+	"nld": "nl",
+}
+
+var languageNames = map[string]string{
+	"en": "English",
+	"ru": "Русский",
+	"uk": "Українська",
+	"de": "Deutsch",
+	"fr": "Français",
+	"es": "Español",
+	"it": "Italiano",
+	"pt": "Português",
+	"ja": "日本語",
+	"zh": "中文",
+	"ko": "한국어",
+	"pl": "Polski",
+	"nl": "Nederlands",
+}
+
+// normalizeLanguage returns the two-letter code for a language tag, or
+// "und" when the tag is empty
+func normalizeLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "und"
+	}
+	if code, ok := languageCodes[tag]; ok {
+		return code
+	}
+	return tag
+}
+
+func languageName(code string) string {
+	if name, ok := languageNames[code]; ok {
+		return name
+	}
+	return code
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	orderName    = "name"
+	orderShuffle = "shuffle"
+)
+
+func isVideoFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".mp4" || ext == ".mkv"
+}
+
+// listLibrary returns the video files in the library folder with their
+// current size and modification time
+func listLibrary(folder string) (map[string]fileState, error) {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	library := map[string]fileState{}
+	for _, file := range files {
+		if file.IsDir() || !isVideoFile(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		library[file.Name()] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return library, nil
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// settled tells whether a file stayed unchanged for a full library poll.
+// One written to more recently may still be being copied.
+func (s fileState) settled(now time.Time) bool {
+	poll := config.LibraryPoll
+	if poll <= 0 {
+		poll = 10
+	}
+	return now.Sub(s.modTime) >= time.Duration(poll)*time.Second
+}
+
+// libraryWatcher polls the library folder and keeps the queue in sync.
+// New files only join once their size stayed the same for a full poll,
+// so a file that is still being copied is never played half way. Files
+// the startup scan left out for the same reason join the same way.
+type libraryWatcher struct {
+	ch      *Channel
+	known   map[string]bool
+	pending map[string]fileState
+}
+
+func (ch *Channel) watchLibrary(ctx context.Context, interval time.Duration) {
+	lw := &libraryWatcher{ch: ch, known: map[string]bool{}, pending: map[string]fileState{}}
+	ch.mutex.Lock()
+	for _, name := range ch.videoQueue {
+		lw.known[name] = true
+	}
+	ch.mutex.Unlock()
+	if library, err := listLibrary(ch.config.VideoFolder); err == nil {
+		for name, state := range library {
+			if !lw.known[name] {
+				lw.pending[name] = state
+			}
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lw.poll()
+		}
+	}
+}
+
+func (lw *libraryWatcher) poll() {
+	ch := lw.ch
+	library, err := listLibrary(ch.config.VideoFolder)
+	if err != nil {
+		log.Printf("[%s] Error reading video folder: %v\n", ch.name, err)
+		return
+	}
+
+	added := []string{}
+	for name, state := range library {
+		if lw.known[name] {
+			continue
+		}
+		if last, ok := lw.pending[name]; ok && last == state {
+			delete(lw.pending, name)
+			lw.known[name] = true
+			added = append(added, name)
+		} else {
+			lw.pending[name] = state
+		}
+	}
+
+	removed := []string{}
+	for name := range lw.known {
+		if _, ok := library[name]; !ok {
+			delete(lw.known, name)
+			removed = append(removed, name)
+		}
+	}
+	for name := range lw.pending {
+		if _, ok := library[name]; !ok {
+			delete(lw.pending, name)
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	ch.mutex.Lock()
+	for _, name := range removed {
+		for i := len(ch.videoQueue) - 1; i >= 0; i-- {
+			if ch.videoQueue[i] == name {
+				ch.removeQueueItem(i)
+			}
+		}
+		log.Printf("[%s] Removed from library: %s\n", ch.name, name)
+	}
+	for _, name := range added {
+		ch.mergeIntoQueue(name)
+		log.Printf("[%s] Added to library: %s\n", ch.name, name)
+	}
+	ch.mutex.Unlock()
+
+	for _, name := range added {
+		cache.Enqueue(ch, filepath.Join(ch.config.VideoFolder, name))
+		thumbnails.Enqueue(filepath.Join(ch.config.VideoFolder, name))
+	}
+}
+
+// mergeIntoQueue adds a new library file where the ordering mode puts it.
+// The caller must hold ch.mutex.
+func (ch *Channel) mergeIntoQueue(name string) {
+	for _, file := range ch.videoQueue {
+		if file == name {
+			return
+		}
+	}
+
+	if ch.config.QueueOrder == orderShuffle {
+		// Somewhere between the next program and the end of the queue,
+		// so it plays before the queue wraps around
+		start := ch.currentIndex
+		if start > len(ch.videoQueue) {
+			start = len(ch.videoQueue)
+		}
+		ch.insertQueueItem(start+rand.Intn(len(ch.videoQueue)-start+1), name)
+		return
+	}
+
+	pos := len(ch.videoQueue)
+	for i, file := range ch.videoQueue {
+		if file > name {
+			pos = i
+			break
+		}
+	}
+	ch.insertQueueItem(pos, name)
+}
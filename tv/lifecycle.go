@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ffmpegStopTimeout is how long ffmpeg gets to close its outputs after
+// SIGTERM before it is killed
+const ffmpegStopTimeout = 5 * time.Second
+
+// ffmpegCommand is exec.CommandContext that stops ffmpeg with SIGTERM when
+// the context ends, so it finishes the current segment instead of leaving
+// a truncated one behind
+func ffmpegCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = ffmpegStopTimeout
+	return cmd
+}
+
+// startStreaming begins playout from a clean output folder. It returns
+// false when playout is already running.
+func (ch *Channel) startStreaming() bool {
+	return ch.startPlayout(false)
+}
+
+// startPlayout is startStreaming, optionally opening with the tuning in
+// slate so the first viewer has something to play right away
+func (ch *Channel) startPlayout(slate bool) bool {
+	ch.lifecycleLock.Lock()
+	defer ch.lifecycleLock.Unlock()
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if ch.isStreaming {
+		return false
+	}
+
+	// Remove existing static stream files
+	ch.resetOutputs()
+	if slate && ch.slate != nil {
+		if err := appendSegmentSets(ch.beginOutput(""), ch.slate); err != nil {
+			log.Printf("[%s] Error publishing slate: %v\n", ch.name, err)
+		}
+	}
+
+	ch.isStreaming = true
+	ch.lastRequest = time.Now()
+	ch.streamingDone = make(chan bool)
+	var ctx context.Context
+	ctx, ch.stopStream = context.WithCancel(context.Background())
+	go ch.startStreamProcess(ctx)
+
+	log.Printf("[%s] Streaming started\n", ch.name)
+	return true
+}
+
+// stopStreaming ends playout and waits until ffmpeg has exited. The
+// playlists are then either ended or removed, depending on config.
+// It returns false when playout was not running.
+func (ch *Channel) stopStreaming() bool {
+	return ch.stopPlayout(false)
+}
+
+// stopPlayout is stopStreaming. An idle stop keeps the current program so
+// the next start can catch up with the schedule from it.
+func (ch *Channel) stopPlayout(idle bool) bool {
+	ch.lifecycleLock.Lock()
+	defer ch.lifecycleLock.Unlock()
+	ch.mutex.Lock()
+	if !ch.isStreaming {
+		ch.mutex.Unlock()
+		return false
+	}
+	ch.isStreaming = false
+	ch.stopStream()
+	done := ch.streamingDone
+	ch.mutex.Unlock()
+
+	<-done
+
+	ch.mutex.Lock()
+	ch.currentCancel = nil
+	ch.parked = idle && ch.nowPlaying.File != ""
+	ch.parkedIndex = ch.playingIndex
+	ch.resume = nil
+	if !ch.parked {
+		ch.nowPlaying = Program{}
+		ch.lastPick = time.Time{}
+	}
+	ch.playingIndex = -1
+	ch.mutex.Unlock()
+
+	os.RemoveAll(ch.liveDir())
+	if config.ClearOnStop {
+		ch.resetOutputs()
+	} else {
+		ch.finishOutputs()
+	}
+
+	log.Printf("[%s] Streaming stopped\n", ch.name)
+	return true
+}
+
+func startStreamHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	if !ch.startStreaming() {
+		fmt.Fprintf(w, "Streaming is already running")
+		return
+	}
+	fmt.Fprintf(w, "Streaming started")
+}
+
+func stopStreamHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	if !ch.stopStreaming() {
+		fmt.Fprintf(w, "Streaming is not running")
+		return
+	}
+	fmt.Fprintf(w, "Streaming stopped")
+}
+
+func restartStreamHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.stopStreaming()
+	ch.startStreaming()
+	fmt.Fprintf(w, "Streaming restarted")
+}
+
+// shutdown stops playout and background encodes before the process exits,
+// so no ffmpeg is left writing segments behind us
+func shutdown(server *http.Server) {
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+
+	// Channels stop in parallel, each may wait for its ffmpeg to exit
+	var wg sync.WaitGroup
+	for _, ch := range channelOrder {
+		wg.Add(1)
+		go func(ch *Channel) {
+			defer wg.Done()
+			ch.stopStreaming()
+		}(ch)
+	}
+	wg.Wait()
+
+	cache.Stop()
+	thumbnails.Stop()
+	audit.Close()
+	os.RemoveAll(config.WorkDir)
+}
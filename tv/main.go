@@ -1,221 +1,363 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	videoFolder   = "../video"
-	videoQueue    []string
-	currentIndex  int
-	currentCmd    *exec.Cmd
-	mutex         sync.Mutex
-	isStreaming   bool
-	streamingDone chan bool
+	cache      *TranscodeCache
+	quarantine *Quarantine
+	thumbnails *Thumbnails
+	audit      *AuditLog
 )
 
 func main() {
-	// Create static folder
-	os.MkdirAll("static", os.ModePerm)
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	configs, err := channelConfigs()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Who controlled the channels and when
+	audit, err = NewAuditLog(config.Auth.AuditLog)
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	if !config.Auth.enabled() {
+		log.Println("No API tokens or users configured, anybody may control the channels")
+	}
+
+	// Stop cleanly on Ctrl-C and when systemd or Docker ask us to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Keep sources that keep failing out of playout
+	quarantine = NewQuarantine(config.QuarantineFile, config.QuarantineAfter)
+
+	// Transcode the libraries in the background so playout rarely encodes live
+	cache = NewTranscodeCache(config.CacheFolder, config.CacheWorkers, config.CacheCPUBudget)
+	cache.Start()
+
+	// Posters and seek previews for the web page and the guide
+	thumbnails = NewThumbnails(config.ThumbnailFolder, config.ThumbnailInterval)
+	thumbnails.Start()
+
+	for _, cfg := range configs {
+		if channels[cfg.Name] != nil {
+			log.Fatalf("Duplicate channel name: %s", cfg.Name)
+		}
+		ch := NewChannel(cfg)
+		channels[ch.name] = ch
+		channelOrder = append(channelOrder, ch)
+
+		// Encode ads and idents ahead of time
+		go ch.prepareClips(ctx)
 
-	// Initialize video queue
-	refillQueue()
+		// Initialize video queue
+		ch.mutex.Lock()
+		ch.refillQueue()
+		ch.mutex.Unlock()
+
+		// Encode only while somebody is watching
+		if cfg.OnDemand {
+			go ch.prepareSlate(ctx)
+			go ch.watchIdle(ctx)
+		}
+
+		// Pick up files added to or removed from the library
+		if config.LibraryPoll > 0 {
+			go ch.watchLibrary(ctx, time.Duration(config.LibraryPoll)*time.Second)
+		}
+	}
 
 	// Set up HTTP handlers
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/start", startStreamHandler)
-	http.HandleFunc("/skip", skipVideoHandler)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.HandleFunc("GET /{$}", page(indexHandler))
+	http.HandleFunc("/epg.json", epgJSONHandler)
+	http.HandleFunc("/epg.xml", epgXMLTVHandler)
+	http.HandleFunc("/channels.m3u", channelListHandler)
+	http.HandleFunc("GET /api/quarantine", quarantineListHandler)
+	http.HandleFunc("POST /api/quarantine/release", control(quarantineReleaseHandler))
+	http.HandleFunc("GET /thumbnails/{hash}/{file}", thumbnailHandler)
+
+	// Every channel is served under /channels/{name}/, the old top-level
+	// routes act on the first channel
+	for _, prefix := range []string{"/channels/{name}", ""} {
+		http.HandleFunc(prefix+"/start", control(withChannel(startStreamHandler)))
+		http.HandleFunc(prefix+"/stop", control(withChannel(stopStreamHandler)))
+		http.HandleFunc(prefix+"/restart", control(withChannel(restartStreamHandler)))
+		http.HandleFunc(prefix+"/skip", control(withChannel(skipVideoHandler)))
+		http.HandleFunc(prefix+"/splice", control(withChannel(spliceClipHandler)))
+
+		// JSON API for the control panel and scripts
+		http.HandleFunc("GET "+prefix+"/api/queue", withChannel(queueHandler))
+		http.HandleFunc("POST "+prefix+"/api/queue/jump", control(withChannel(jumpHandler)))
+		http.HandleFunc("POST "+prefix+"/api/queue/enqueue", control(withChannel(enqueueHandler)))
+		http.HandleFunc("POST "+prefix+"/api/queue/move", control(withChannel(moveHandler)))
+		http.HandleFunc("DELETE "+prefix+"/api/queue/{index}", control(withChannel(removeHandler)))
+		http.HandleFunc("POST "+prefix+"/api/queue/shuffle", control(withChannel(shuffleHandler)))
+		http.HandleFunc("POST "+prefix+"/api/queue/refill", control(withChannel(refillHandler)))
+		http.HandleFunc("POST "+prefix+"/api/start", control(withChannel(apiStartHandler)))
+		http.HandleFunc("POST "+prefix+"/api/stop", control(withChannel(apiStopHandler)))
+		http.HandleFunc("POST "+prefix+"/api/restart", control(withChannel(apiRestartHandler)))
+		http.HandleFunc("POST "+prefix+"/api/skip", control(withChannel(apiSkipHandler)))
+		http.HandleFunc("POST "+prefix+"/api/hold", control(withChannel(holdHandler)))
+		http.HandleFunc("POST "+prefix+"/api/hold/release", control(withChannel(releaseHoldHandler)))
+	}
+	http.HandleFunc("GET /channels/{name}/{$}", page(withChannel(channelPageHandler)))
+	http.HandleFunc("GET /channels/{name}/epg.json", withChannel(channelEPGHandler))
+	http.HandleFunc("/channels/{name}/{file}", withChannel(channelFileHandler))
+	http.HandleFunc("/static/{file}", withChannel(channelFileHandler))
 
 	// Start the server
+	server := &http.Server{Addr: "0.0.0.0:8080"}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 	fmt.Println("Server started at http://0.0.0.0:8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+
+	<-ctx.Done()
+	shutdown(server)
 }
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	html := `
+var indexTemplate = template.Must(template.New("index").Parse(`
 <!DOCTYPE html>
 <html>
 <head>
     <title>Video Streaming Service</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; }
+        li { margin: 8px 0; }
+        li img { width: 80px; vertical-align: middle; margin-right: 8px; }
+    </style>
+</head>
+<body>
+    <h1>Channels</h1>
+    <ul>
+        {{range .}}
+        <li>{{if .Poster}}<img src="{{.Poster}}" alt="">{{end}}<a href="/channels/{{.Name}}/">{{.Title}}</a>{{if .Playing}} &mdash; {{.Playing}}{{end}}</li>
+        {{end}}
+    </ul>
+    <p><a href="/channels.m3u">M3U channel list</a> &middot; <a href="/epg.xml">XMLTV guide</a></p>
+</body>
+</html>
+`))
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	type channelEntry struct {
+		Name    string
+		Title   string
+		Playing string
+		Poster  string
+	}
+
+	entries := []channelEntry{}
+	for _, ch := range channelOrder {
+		ch.mutex.Lock()
+		poster, _ := ch.thumbnailURLs(ch.nowPlaying.File)
+		entries = append(entries, channelEntry{Name: ch.name, Title: ch.config.ChannelName, Playing: ch.nowPlaying.Title, Poster: poster})
+		ch.mutex.Unlock()
+	}
+	indexTemplate.Execute(w, entries)
+}
+
+// channelFileHandler serves the playlists and segments of a channel. Every
+// request counts as a viewer and starts an on-demand channel.
+func channelFileHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.touchViewer(r)
+	if ch.config.OnDemand {
+		ch.tuneIn()
+	}
+	file := filepath.Base(r.PathValue("file"))
+	switch filepath.Ext(file) {
+	case ".mpd":
+		w.Header().Set("Content-Type", "application/dash+xml")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	}
+	http.ServeFile(w, r, filepath.Join(ch.outputDir, file))
+}
+
+var channelTemplate = template.Must(template.New("channel").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.}}</title>
     <script src="https://cdnjs.cloudflare.com/ajax/libs/hls.js/1.1.5/hls.min.js"></script>
     <style>
         body { font-family: Arial, sans-serif; margin: 20px; }
         video { width: 640px; height: 480px; background: #000; }
         button { margin: 10px 0; padding: 8px 16px; }
+        #guide { list-style: none; padding: 0; }
+        #guide li { display: flex; align-items: center; margin: 8px 0; }
+        .poster { width: 160px; height: 120px; margin-right: 12px; background: #000 center / contain no-repeat; }
     </style>
 </head>
 <body>
-    <h1>Video Streaming Service</h1>
+    <h1>{{.}}</h1>
+    <p><a href="/">All channels</a></p>
     <video id="video" controls></video>
     <div>
         <button onclick="startStream()">Start Streaming</button>
         <button onclick="skipVideo()">Skip Video</button>
+        <button onclick="stopStream()">Stop Streaming</button>
+        <button onclick="restartStream()">Restart Streaming</button>
+        <button onclick="hold()">Hold</button>
+        <button onclick="releaseHold()">Release Hold</button>
     </div>
+    <h2>Guide</h2>
+    <ul id="guide"></ul>
     <script>
         function startStream() {
-            fetch('/start')
-                .then(response => response.text())
+            fetch('api/start', { method: 'POST' })
+                .then(response => response.json())
                 .then(data => {
                     console.log(data);
                     setupPlayer();
                 });
         }
         
+        function stopStream() {
+            fetch('api/stop', { method: 'POST' })
+                .then(response => response.json())
+                .then(data => console.log(data));
+        }
+
+        function restartStream() {
+            fetch('api/restart', { method: 'POST' })
+                .then(response => response.json())
+                .then(data => {
+                    console.log(data);
+                    setupPlayer();
+                });
+        }
+
         function skipVideo() {
-            fetch('/skip')
-                .then(response => response.text())
+            fetch('api/skip', { method: 'POST' })
+                .then(response => response.json())
                 .then(data => console.log(data));
         }
         
+        function hold() {
+            fetch('api/hold', { method: 'POST' })
+                .then(response => response.json())
+                .then(data => console.log(data));
+        }
+
+        function releaseHold() {
+            fetch('api/hold/release', { method: 'POST' })
+                .then(response => response.json())
+                .then(data => console.log(data));
+        }
+
         function setupPlayer() {
             var video = document.getElementById('video');
             if (Hls.isSupported()) {
                 var hls = new Hls();
-                hls.loadSource('/static/stream.m3u8');
+                hls.loadSource('master.m3u8');
                 hls.attachMedia(video);
                 hls.on(Hls.Events.MANIFEST_PARSED, function() {
                     video.play();
                 });
             } else if (video.canPlayType('application/vnd.apple.mpegurl')) {
-                video.src = '/static/stream.m3u8';
+                video.src = 'master.m3u8';
                 video.addEventListener('loadedmetadata', function() {
                     video.play();
                 });
             }
         }
         
+        function formatTime(iso) {
+            return new Date(iso).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+        }
+
+        // parseVTT reads the cues of a thumbnail track as {start, url, x, y, w, h}
+        function parseVTT(text, base) {
+            var cues = [];
+            text.split('\n\n').forEach(function(block) {
+                var lines = block.trim().split('\n');
+                if (lines.length < 2 || lines[0].indexOf('-->') < 0) return;
+                var start = lines[0].split('-->')[0].trim().split(':');
+                var seconds = (+start[0]) * 3600 + (+start[1]) * 60 + parseFloat(start[2]);
+                var parts = lines[1].split('#xywh=');
+                var xywh = parts[1].split(',').map(Number);
+                cues.push({ start: seconds, url: new URL(parts[0], base).href, x: xywh[0], y: xywh[1], w: xywh[2], h: xywh[3] });
+            });
+            return cues;
+        }
+
+        // Hovering a poster scrubs through the program with its preview sprite
+        function attachPreview(el, program) {
+            var cues = null;
+            var base = new URL(program.preview, location.href).href;
+            el.addEventListener('mouseenter', function() {
+                if (cues) return;
+                fetch(program.preview).then(r => r.text()).then(text => { cues = parseVTT(text, base); });
+            });
+            el.addEventListener('mousemove', function(e) {
+                if (!cues || cues.length == 0) return;
+                var rect = el.getBoundingClientRect();
+                var cue = cues[Math.min(cues.length - 1, Math.floor((e.clientX - rect.left) / rect.width * cues.length))];
+                el.style.backgroundImage = 'url(' + cue.url + ')';
+                el.style.backgroundPosition = (-cue.x) + 'px ' + (-cue.y) + 'px';
+                el.style.backgroundSize = 'auto';
+            });
+            el.addEventListener('mouseleave', function() {
+                el.style.backgroundImage = 'url(' + program.poster + ')';
+                el.style.backgroundPosition = '';
+                el.style.backgroundSize = '';
+            });
+        }
+
+        function loadGuide() {
+            fetch('epg.json')
+                .then(response => response.json())
+                .then(data => {
+                    var guide = document.getElementById('guide');
+                    guide.innerHTML = '';
+                    data.programs.slice(0, 10).forEach(function(program) {
+                        var li = document.createElement('li');
+                        var poster = document.createElement('div');
+                        poster.className = 'poster';
+                        if (program.poster) {
+                            poster.style.backgroundImage = 'url(' + program.poster + ')';
+                        }
+                        if (program.preview) {
+                            attachPreview(poster, program);
+                        }
+                        var text = document.createElement('span');
+                        text.textContent = formatTime(program.start) + ' ' + program.title;
+                        li.appendChild(poster);
+                        li.appendChild(text);
+                        guide.appendChild(li);
+                    });
+                });
+        }
+
         // Auto setup player if stream is already running
         window.onload = function() {
             setupPlayer();
+            loadGuide();
+            setInterval(loadGuide, 60000);
         };
     </script>
 </body>
 </html>
-`
-	fmt.Fprintf(w, html)
-}
-
-func startStreamHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	if isStreaming {
-		fmt.Fprintf(w, "Streaming is already running")
-		return
-	}
-
-	// Remove existing static stream files
-	files, _ := filepath.Glob("static/stream*.ts")
-	for _, f := range files {
-		os.Remove(f)
-	}
-	os.Remove("static/stream.m3u8")
-
-	// Start streaming
-	isStreaming = true
-	streamingDone = make(chan bool)
-	go startStreamProcess()
-
-	fmt.Fprintf(w, "Streaming started")
-}
-
-func skipVideoHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	if currentCmd != nil && currentCmd.Process != nil {
-		// Kill the current process
-		currentCmd.Process.Kill()
-		fmt.Fprintf(w, "Skipped to the next video")
-	} else {
-		fmt.Fprintf(w, "No video is currently playing")
-	}
-}
-
-func startStreamProcess() {
-	for isStreaming {
-		processNextVideo()
-	}
-	close(streamingDone)
-}
-
-func processNextVideo() {
-	mutex.Lock()
-	if len(videoQueue) == 0 {
-		refillQueue()
-	}
-
-	if len(videoQueue) == 0 {
-		mutex.Unlock()
-		log.Println("No videos found in the queue")
-		time.Sleep(5 * time.Second)
-		return
-	}
-
-	videoFile := videoQueue[currentIndex]
-	currentIndex = (currentIndex + 1) % len(videoQueue)
-	mutex.Unlock()
-
-	videoPath := filepath.Join(videoFolder, videoFile)
-	log.Printf("Processing video: %s\n", videoPath)
-
-	// Build FFmpeg command similar to the Python version
-	cmd := exec.Command(
-		"ffmpeg",
-		"-re",
-		"-i", videoPath,
-		"-c:v", "libx264",
-		"-preset", "ultrafast",
-		"-vf", `[in]scale=320:240:force_original_aspect_ratio=decrease,pad=320:240:(ow-iw)/2:(oh-ih)/2,drawtext=fontsize=25:fontcolor=white:text='пися палыч тв':x=25:y=25,drawtext=fontsize=18:fontcolor=white:text='%{localtime\:%T}':x=25:y=55[out]`,
-		"-hls_time", "3",
-		"-hls_list_size", "10",
-		"-f", "hls",
-		"-hls_flags", "delete_segments+append_list+omit_endlist",
-		"-hls_delete_threshold", "10",
-		"static/stream.m3u8",
-	)
-
-	// Store current command to allow killing it later
-	mutex.Lock()
-	currentCmd = cmd
-	mutex.Unlock()
-
-	// Execute FFmpeg
-	err := cmd.Run()
-	if err != nil {
-		// Check if the process was killed intentionally
-		if strings.Contains(err.Error(), "killed") {
-			log.Println("Video was skipped")
-		} else {
-			log.Printf("FFmpeg error: %v\n", err)
-		}
-	}
-}
-
-func refillQueue() {
-	// Using os.ReadDir instead of ioutil.ReadDir
-	files, err := os.ReadDir(videoFolder)
-	if err != nil {
-		log.Printf("Error reading video folder: %v\n", err)
-		videoQueue = []string{}
-		return
-	}
-
-	videoQueue = []string{}
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".mp4") {
-			videoQueue = append(videoQueue, file.Name())
-		}
-	}
+`))
 
-	log.Printf("Video queue refilled with %d videos\n", len(videoQueue))
+func channelPageHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	channelTemplate.Execute(w, ch.config.ChannelName)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeMasterPlaylist lists the video playlist together with its audio
+// and subtitle renditions. Clients should always load master.m3u8.
+func (ch *Channel) writeMasterPlaylist() error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	p := ch.profile
+	streamInfo := fmt.Sprintf("BANDWIDTH=%d,RESOLUTION=%dx%d", p.bandwidth(), p.Width, p.Height)
+	if ch.config.DASH {
+		b.WriteString("#EXT-X-VERSION:7\n")
+		streamInfo += fmt.Sprintf(",CODECS=\"%s,%s\"", p.videoCodec(), p.audioCodec())
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+
+	if len(ch.audioRenditions) > 0 {
+		for i, r := range ch.audioRenditions {
+			isDefault := "NO"
+			if i == 0 {
+				isDefault = "YES"
+			}
+			fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n",
+				languageName(r.language), r.language, isDefault, r.playlist.name)
+		}
+		streamInfo += ",AUDIO=\"aud\""
+	}
+	if len(ch.subtitleRenditions) > 0 {
+		for i, s := range ch.subtitleRenditions {
+			isDefault := "NO"
+			if i == 0 {
+				isDefault = "YES"
+			}
+			fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n",
+				languageName(s.language), s.language, isDefault, s.playlist.name)
+		}
+		streamInfo += ",SUBTITLES=\"subs\""
+	}
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s\n", streamInfo, ch.playlist.name)
+
+	path := filepath.Join(ch.outputDir, "master.m3u8")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// finishOutputs ends every published playlist, leaving the segments in
+// place so viewers can play out what is left
+func (ch *Channel) finishOutputs() {
+	ch.playlist.Finish()
+	for _, r := range ch.audioRenditions {
+		r.playlist.Finish()
+	}
+	for _, s := range ch.subtitleRenditions {
+		s.playlist.Finish()
+	}
+	if ch.config.DASH {
+		ch.writeDASHManifest()
+	}
+}
+
+// resetOutputs clears every published playlist and segment and writes a
+// fresh master playlist
+func (ch *Channel) resetOutputs() {
+	ch.playlist.Reset()
+	for _, r := range ch.audioRenditions {
+		r.playlist.Reset()
+	}
+	for _, s := range ch.subtitleRenditions {
+		s.playlist.Reset()
+	}
+	os.RemoveAll(filepath.Join(ch.workDir, "subs"))
+	os.Remove(filepath.Join(ch.outputDir, dashManifest))
+	ch.writeMasterPlaylist()
+}
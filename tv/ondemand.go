@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// viewerTimeout is how long a client counts as watching after its last
+// playlist or segment request. Players reload the live playlist every
+// segment, so this only needs to cover a few of them.
+const viewerTimeout = 30 * time.Second
+
+// slateSegments is how many segments the tuning in slate lasts, enough to
+// cover the encoder producing its first segments
+const slateSegments = 2
+
+// touchViewer records a playlist or segment request
+func (ch *Channel) touchViewer(r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	now := time.Now()
+	ch.mutex.Lock()
+	ch.viewers[host] = now
+	ch.lastRequest = now
+	ch.mutex.Unlock()
+}
+
+// viewerCount forgets clients that stopped requesting and counts the rest.
+// The caller must hold ch.mutex.
+func (ch *Channel) viewerCount() int {
+	for host, seen := range ch.viewers {
+		if time.Since(seen) > viewerTimeout {
+			delete(ch.viewers, host)
+		}
+	}
+	return len(ch.viewers)
+}
+
+// tuneIn starts playout of an on-demand channel for its first viewer
+func (ch *Channel) tuneIn() {
+	ch.mutex.Lock()
+	streaming := ch.isStreaming
+	ch.mutex.Unlock()
+	if streaming {
+		return
+	}
+
+	if ch.startPlayout(true) {
+		log.Printf("[%s] Viewer tuned in, playout started\n", ch.name)
+	}
+}
+
+// watchIdle stops playout once nobody requested a playlist or segment of
+// the channel for the idle timeout
+func (ch *Channel) watchIdle(ctx context.Context) {
+	timeout := time.Duration(ch.config.IdleTimeout) * time.Second
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ch.mutex.Lock()
+		idle := ch.isStreaming && time.Since(ch.lastRequest) > timeout
+		ch.mutex.Unlock()
+
+		if idle && ch.stopPlayout(true) {
+			log.Printf("[%s] No viewers for %s, playout idled\n", ch.name, timeout)
+		}
+	}
+}
+
+// prepareSlate encodes the tuning in slate with the channel's encode
+// settings, so it splices in front of the first program like a clip
+func (ch *Channel) prepareSlate(ctx context.Context) {
+	duration := strconv.Itoa(slateSegments * ch.config.SegmentTime)
+	dir := filepath.Join(ch.workDir, "slate")
+	source := dir + ".mp4"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.ModePerm)
+
+	filter := fmt.Sprintf("drawtext=fontsize=25:fontcolor=white:expansion=none:text=%s:x=(w-tw)/2:y=(h-th)/2-20,"+
+		"drawtext=fontsize=18:fontcolor=white:expansion=none:text='Tuning in...':x=(w-tw)/2:y=(h-th)/2+20",
+		escapeFilterValue(ch.config.ChannelName))
+	cmd := ffmpegCommand(ctx, "ffmpeg", "-nostdin", "-y",
+		"-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%dx%d:r=25", ch.profile.Width, ch.profile.Height),
+		"-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo",
+		"-t", duration,
+		"-vf", filter,
+		"-c:v", "libx264",
+		"-preset", "ultrafast",
+		"-c:a", "aac",
+		source,
+	)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[%s] Error creating slate: %v\n", ch.name, err)
+		}
+		return
+	}
+
+	cmd = ffmpegCommand(ctx, "ffmpeg", ch.encodeArgs(source, encodeClip, dir, 0)...)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[%s] Error encoding slate: %v\n", ch.name, err)
+		}
+		return
+	}
+
+	sets, err := ch.readTrackSets(dir)
+	if err != nil {
+		log.Printf("[%s] Error loading slate: %v\n", ch.name, err)
+		return
+	}
+	ch.mutex.Lock()
+	ch.slate = sets
+	ch.mutex.Unlock()
+}
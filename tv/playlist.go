@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segment is a media segment published in the live playlist
+type Segment struct {
+	Name          string
+	Duration      float64
+	Discontinuity bool
+	// Init is the fMP4 initialization segment, empty for MPEG-TS
+	Init string
+
+	// Start is the wall clock time the segment airs at and MediaTime its
+	// offset in the encode it came from. Both are only set on published
+	// segments, they drive the HLS program date and the DASH timeline.
+	Start     time.Time
+	MediaTime float64
+	Period    *Period
+}
+
+// Period is one program in a live playlist, a period in DASH terms
+type Period struct {
+	ID        int
+	Start     time.Time
+	MediaTime float64
+}
+
+// LivePlaylist owns the sliding window of the live HLS playlist.
+// Segments from any source are moved or linked into the output folder,
+// old ones are kept on disk for a while after they leave the window so
+// slow clients can still fetch them.
+type LivePlaylist struct {
+	mu             sync.Mutex
+	dir            string
+	name           string
+	windowSize     int
+	retain         int
+	targetDuration int
+	mediaSequence  int
+	discSequence   int
+	nextSegment    int
+	discontinuity  bool
+	ended          bool
+	segments       []Segment
+	expired        []Segment
+
+	// Timeline of the published segments
+	epoch     time.Time
+	clock     time.Time
+	mediaTime float64
+	periodID  int
+	period    *Period
+	init      string
+	nextInit  int
+}
+
+func NewLivePlaylist(dir, name string, windowSize, retain, targetDuration int) *LivePlaylist {
+	now := time.Now()
+	return &LivePlaylist{
+		dir:            dir,
+		name:           name,
+		windowSize:     windowSize,
+		retain:         retain,
+		targetDuration: targetDuration,
+		epoch:          now,
+		clock:          now,
+	}
+}
+
+// Reset removes every published segment and the playlist itself
+func (pl *LivePlaylist) Reset() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	prefix := strings.TrimSuffix(pl.name, filepath.Ext(pl.name))
+	files, _ := filepath.Glob(filepath.Join(pl.dir, prefix+"*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+
+	pl.mediaSequence = 0
+	pl.discSequence = 0
+	pl.nextSegment = 0
+	pl.discontinuity = false
+	pl.ended = false
+	pl.segments = nil
+	pl.expired = nil
+	pl.epoch = time.Now()
+	pl.clock = pl.epoch
+	pl.mediaTime = 0
+	pl.periodID = 0
+	pl.period = nil
+	pl.init = ""
+	pl.nextInit = 0
+}
+
+// Finish ends the playlist so players stop polling for new segments
+func (pl *LivePlaylist) Finish() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.ended = true
+	return pl.write()
+}
+
+// Discontinuity marks the next appended segment as the start of a new
+// timeline, in the period with the given ID. Every track of a program gets
+// the same ID, so DASH can match them up even when one track is missing
+// segments.
+func (pl *LivePlaylist) Discontinuity(period int) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if len(pl.segments) > 0 || pl.mediaSequence > 0 {
+		pl.discontinuity = true
+	}
+	pl.periodID = period
+	pl.period = nil
+	pl.init = ""
+	pl.mediaTime = 0
+}
+
+// SetMediaTime sets the media time of the next segment, for programs that
+// don't start at the beginning of their encode
+func (pl *LivePlaylist) SetMediaTime(t float64) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.mediaTime = t
+}
+
+// SetInit publishes the fMP4 initialization segment at src for the
+// segments appended from now on
+func (pl *LivePlaylist) SetInit(src string) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	prefix := strings.TrimSuffix(pl.name, filepath.Ext(pl.name))
+	name := fmt.Sprintf("%sinit%d%s", prefix, pl.nextInit, filepath.Ext(src))
+	if err := linkOrCopy(src, filepath.Join(pl.dir, name)); err != nil {
+		return fmt.Errorf("failed to publish init segment %s: %w", src, err)
+	}
+	pl.nextInit++
+	pl.init = name
+	return nil
+}
+
+// Snapshot returns a copy of the segments in the window and whether the
+// playlist has ended
+func (pl *LivePlaylist) Snapshot() ([]Segment, bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return append([]Segment(nil), pl.segments...), pl.ended
+}
+
+// Epoch is when the timeline of the playlist started
+func (pl *LivePlaylist) Epoch() time.Time {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.epoch
+}
+
+// Append publishes the segment file at src. When move is true the file is
+// renamed into place, otherwise it is hard linked (or copied) so the
+// source can be reused, as pre-encoded clips are.
+func (pl *LivePlaylist) Append(src string, duration float64, move bool) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	prefix := strings.TrimSuffix(pl.name, filepath.Ext(pl.name))
+	name := fmt.Sprintf("%s%d%s", prefix, pl.nextSegment, filepath.Ext(src))
+	dst := filepath.Join(pl.dir, name)
+
+	var err error
+	if move {
+		err = os.Rename(src, dst)
+	} else {
+		err = linkOrCopy(src, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish segment %s: %w", src, err)
+	}
+	pl.nextSegment++
+
+	// A program starts when its first segment began, but never before the
+	// previous one ended. Its other segments follow back to back.
+	span := time.Duration(duration * float64(time.Second))
+	start := pl.clock
+	if pl.period == nil {
+		if t := time.Now().Add(-span); t.After(start) {
+			start = t
+		}
+		pl.period = &Period{ID: pl.periodID, Start: start, MediaTime: pl.mediaTime}
+	}
+	pl.clock = start.Add(span)
+
+	pl.segments = append(pl.segments, Segment{
+		Name:          name,
+		Duration:      duration,
+		Discontinuity: pl.discontinuity,
+		Init:          pl.init,
+		Start:         start,
+		MediaTime:     pl.mediaTime,
+		Period:        pl.period,
+	})
+	pl.mediaTime += duration
+	pl.discontinuity = false
+	pl.ended = false
+
+	if d := int(math.Ceil(duration)); d > pl.targetDuration {
+		pl.targetDuration = d
+	}
+
+	// Slide the window and drop segments that are past retention
+	for len(pl.segments) > pl.windowSize {
+		if pl.segments[0].Discontinuity {
+			pl.discSequence++
+		}
+		pl.expired = append(pl.expired, pl.segments[0])
+		pl.segments = pl.segments[1:]
+		pl.mediaSequence++
+	}
+	for len(pl.expired) > pl.retain {
+		old := pl.expired[0]
+		pl.expired = pl.expired[1:]
+		os.Remove(filepath.Join(pl.dir, old.Name))
+		if old.Init != "" && !pl.usesInit(old.Init) {
+			os.Remove(filepath.Join(pl.dir, old.Init))
+		}
+	}
+
+	return pl.write()
+}
+
+// usesInit tells whether a retained segment still needs the init segment
+func (pl *LivePlaylist) usesInit(name string) bool {
+	for _, seg := range pl.expired {
+		if seg.Init == name {
+			return true
+		}
+	}
+	for _, seg := range pl.segments {
+		if seg.Init == name {
+			return true
+		}
+	}
+	return name == pl.init
+}
+
+func (pl *LivePlaylist) write() error {
+	// fMP4 segments need EXT-X-MAP, which needs a newer version
+	version := 3
+	for _, seg := range pl.segments {
+		if seg.Init != "" {
+			version = 7
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", pl.targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", pl.mediaSequence)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", pl.discSequence)
+	mapURI := ""
+	for i, seg := range pl.segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.Init != "" && seg.Init != mapURI {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", seg.Init)
+			mapURI = seg.Init
+		}
+		// Program dates match the DASH timeline, every program starts one
+		if i == 0 || seg.Discontinuity {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.Start.UTC().Format(programDateTime))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n%s\n", seg.Duration, seg.Name)
+	}
+	if pl.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	// Write to a temp file first so clients never read a partial playlist
+	path := filepath.Join(pl.dir, pl.name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// programDateTime is the ISO 8601 layout of EXT-X-PROGRAM-DATE-TIME
+const programDateTime = "2006-01-02T15:04:05.000Z07:00"
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SegmentSet is a media playlist on disk together with its segments, as
+// written by ffmpeg's hls muxer for live encodes and pre-encoded clips.
+type SegmentSet struct {
+	Dir      string
+	Segments []Segment
+	Ended    bool
+	// Init is the fMP4 initialization segment, relative to Dir
+	Init string
+}
+
+func readSegmentSet(playlistPath string) (*SegmentSet, error) {
+	f, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &SegmentSet{Dir: filepath.Dir(playlistPath)}
+	var duration float64
+	discontinuity := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			value, _, _ = strings.Cut(value, ",")
+			duration, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad EXTINF in %s: %w", playlistPath, err)
+			}
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line == "#EXT-X-ENDLIST":
+			set.Ended = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			_, uri, _ := strings.Cut(line, `URI="`)
+			set.Init, _, _ = strings.Cut(uri, `"`)
+		case strings.HasPrefix(line, "#"):
+		default:
+			set.Segments = append(set.Segments, Segment{
+				Name:          line,
+				Duration:      duration,
+				Discontinuity: discontinuity,
+			})
+			duration = 0
+			discontinuity = false
+		}
+	}
+
+	return set, scanner.Err()
+}
+
+// Total returns the summed duration of all segments in the set
+func (s *SegmentSet) Total() float64 {
+	total := 0.0
+	for _, seg := range s.Segments {
+		total += seg.Duration
+	}
+	return total
+}
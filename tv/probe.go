@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type probedDuration struct {
+	modTime  time.Time
+	duration float64
+}
+
+var (
+	durations     = map[string]probedDuration{}
+	durationsLock sync.Mutex
+)
+
+// probeDuration returns the length of a video in seconds using ffprobe.
+// Results are remembered until the file changes.
+func probeDuration(path string) (float64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	durationsLock.Lock()
+	cached, ok := durations[path]
+	durationsLock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.duration, nil
+	}
+
+	cmd := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		path)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(result.Format.Duration, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	durationsLock.Lock()
+	durations[path] = probedDuration{modTime: info.ModTime(), duration: duration}
+	durationsLock.Unlock()
+	return duration, nil
+}
+
+// StreamInfo describes one stream of a media file
+type StreamInfo struct {
+	Index     int
+	TypeIndex int
+	Codec     string
+	Language  string
+	Title     string
+	Default   bool
+}
+
+// probeStreams lists the streams of the given type ("a" for audio, "s" for
+// subtitles) in the order ffmpeg numbers them for -map 0:a:N
+func probeStreams(path string, streamType string) ([]StreamInfo, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_streams",
+		"-select_streams", streamType,
+		path)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Streams []struct {
+			Index       int               `json:"index"`
+			CodecName   string            `json:"codec_name"`
+			Tags        map[string]string `json:"tags"`
+			Disposition map[string]int    `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, err
+	}
+
+	streams := []StreamInfo{}
+	for i, s := range result.Streams {
+		streams = append(streams, StreamInfo{
+			Index:     s.Index,
+			TypeIndex: i,
+			Codec:     s.CodecName,
+			Language:  normalizeLanguage(s.Tags["language"]),
+			Title:     s.Tags["title"],
+			Default:   s.Disposition["default"] == 1,
+		})
+	}
+	return streams, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// EncodingProfile is a named set of encoder settings channels pick from.
+// Every encode of a channel uses its profile, so programs, clips and the
+// slates splice without the player noticing.
+type EncodingProfile struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Preset string `json:"preset"`
+	// CRF is the quality target unless BitrateKbps caps the video rate
+	CRF         int `json:"crf"`
+	BitrateKbps int `json:"bitrateKbps"`
+	// MaxFPS caps the frame rate, slower sources keep theirs
+	MaxFPS           float64 `json:"maxFps"`
+	AudioCodec       string  `json:"audioCodec"`
+	AudioBitrateKbps int     `json:"audioBitrateKbps"`
+	// Passthrough copies H.264 video that already has the resolution and
+	// frame rate of the profile instead of encoding it again. It only
+	// applies when nothing is drawn into the picture, so not with an
+	// overlay or burned in subtitles, and live encodes lose the clock.
+	// Clips and the slate are always encoded.
+	Passthrough bool `json:"passthrough"`
+}
+
+// defaultProfile is the profile channels use unless they name another
+const defaultProfile = "sd240"
+
+// baseProfile is the encode every channel used before profiles existed,
+// profiles in the config fall back to it for the fields they leave out
+var baseProfile = EncodingProfile{
+	Width:            320,
+	Height:           240,
+	Preset:           "ultrafast",
+	CRF:              23,
+	AudioCodec:       "aac",
+	AudioBitrateKbps: 128,
+}
+
+// audioCodecs are the codecs HLS and DASH players accept, with the RFC 6381
+// name the manifests announce them under
+var audioCodecs = map[string]string{
+	"aac":  "mp4a.40.2",
+	"mp3":  "mp4a.40.34",
+	"ac3":  "ac-3",
+	"eac3": "ec-3",
+}
+
+// lookupProfile returns the named profile with unset fields taken from the
+// base profile
+func lookupProfile(name string) (EncodingProfile, error) {
+	p, ok := config.Profiles[name]
+	if !ok {
+		return EncodingProfile{}, fmt.Errorf("unknown encoding profile %q", name)
+	}
+
+	d := baseProfile
+	if p.Width <= 0 || p.Height <= 0 {
+		p.Width, p.Height = d.Width, d.Height
+	}
+	if p.Preset == "" {
+		p.Preset = d.Preset
+	}
+	if p.CRF <= 0 && p.BitrateKbps <= 0 {
+		p.CRF = d.CRF
+	}
+	if p.AudioCodec == "" {
+		p.AudioCodec = d.AudioCodec
+	}
+	if p.AudioBitrateKbps <= 0 {
+		p.AudioBitrateKbps = d.AudioBitrateKbps
+	}
+	if _, ok := audioCodecs[p.AudioCodec]; !ok {
+		return EncodingProfile{}, fmt.Errorf("profile %q: unsupported audio codec %q", name, p.AudioCodec)
+	}
+	return p, nil
+}
+
+// level is the H.264 level pinned for DASH, the lowest that fits the
+// resolution at common frame rates
+func (p EncodingProfile) level() int {
+	switch pixels := p.Width * p.Height; {
+	case pixels <= 720*576:
+		return 30
+	case pixels <= 1280*720:
+		return 31
+	case pixels <= 1920*1080:
+		return 40
+	}
+	return 51
+}
+
+// videoCodec is the RFC 6381 name of the pinned baseline encode
+func (p EncodingProfile) videoCodec() string {
+	return fmt.Sprintf("avc1.42C0%02X", p.level())
+}
+
+func (p EncodingProfile) audioCodec() string {
+	return audioCodecs[p.AudioCodec]
+}
+
+// bandwidth is the peak rate the manifests announce. CRF encodes have no
+// fixed rate, so they are estimated from the picture size.
+func (p EncodingProfile) bandwidth() int {
+	video := p.BitrateKbps
+	if video <= 0 {
+		video = 800 * p.Width * p.Height / (320 * 240)
+	}
+	return (video + p.AudioBitrateKbps) * 1000
+}
+
+// scaleFilter fits the picture into the profile's frame
+func (p EncodingProfile) scaleFilter() string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2",
+		p.Width, p.Height, p.Width, p.Height)
+}
+
+// outputFPS is the frame rate an encode of a source running at fps ends up
+// with, 0 when neither is known
+func (p EncodingProfile) outputFPS(fps float64) float64 {
+	if p.MaxFPS > 0 && (fps <= 0 || fps > p.MaxFPS) {
+		return p.MaxFPS
+	}
+	return fps
+}
+
+// videoCodecArgs encodes H.264 with a keyframe at every segment boundary,
+// so segments all have the target length and cut cleanly between programs
+func (ch *Channel) videoCodecArgs(fps float64) []string {
+	p := ch.profile
+	args := []string{"-c:v", "libx264", "-preset", p.Preset}
+	if p.BitrateKbps > 0 {
+		rate := strconv.Itoa(p.BitrateKbps) + "k"
+		args = append(args, "-b:v", rate, "-maxrate", rate, "-bufsize", strconv.Itoa(2*p.BitrateKbps)+"k")
+	} else {
+		args = append(args, "-crf", strconv.Itoa(p.CRF))
+	}
+	if ch.config.DASH {
+		// Pin the profile so the manifests can announce the codec
+		args = append(args, "-profile:v", "baseline", "-level", fmt.Sprintf("%.1f", float64(p.level())/10))
+	}
+
+	segment := ch.config.SegmentTime
+	args = append(args,
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segment),
+		"-sc_threshold", "0",
+	)
+	if fps > 0 {
+		gop := strconv.Itoa(int(math.Round(fps * float64(segment))))
+		args = append(args, "-g", gop, "-keyint_min", gop)
+	}
+	return args
+}
+
+// canCopyVideo tells whether the video of a program already is what the
+// profile would encode it to, and nothing has to be drawn into it. Clips
+// and the slate are always encoded, copied video keeps the GOP of the
+// source and loses the key frames at segment boundaries they splice on.
+func (ch *Channel) canCopyVideo(video VideoInfo, input string, mode encodeMode) bool {
+	p := ch.profile
+	if mode == encodeClip || !p.Passthrough || video.Codec != "h264" || video.PixFmt != "yuv420p" {
+		return false
+	}
+	if video.Width != p.Width || video.Height != p.Height {
+		return false
+	}
+	if p.MaxFPS > 0 && (video.FPS <= 0 || video.FPS > p.MaxFPS) {
+		return false
+	}
+	if ch.config.DASH {
+		// The manifests announce a baseline codec
+		if !strings.HasSuffix(video.Profile, "Baseline") || video.Level > p.level() {
+			return false
+		}
+	}
+	if ch.config.Overlay != "" || ch.burnSubtitleFilter(input) != "" {
+		return false
+	}
+	return true
+}
+
+// VideoInfo describes the first video stream of a media file
+type VideoInfo struct {
+	Codec   string
+	Profile string
+	Level   int
+	PixFmt  string
+	Width   int
+	Height  int
+	FPS     float64
+}
+
+// probeVideo reads the codec, size and frame rate of the first video stream
+func probeVideo(path string) (VideoInfo, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_streams",
+		"-select_streams", "v:0",
+		path)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return VideoInfo{}, err
+	}
+
+	var result struct {
+		Streams []struct {
+			CodecName    string `json:"codec_name"`
+			Profile      string `json:"profile"`
+			Level        int    `json:"level"`
+			PixFmt       string `json:"pix_fmt"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return VideoInfo{}, err
+	}
+	if len(result.Streams) == 0 {
+		return VideoInfo{}, fmt.Errorf("no video stream")
+	}
+
+	s := result.Streams[0]
+	return VideoInfo{
+		Codec:   s.CodecName,
+		Profile: s.Profile,
+		Level:   s.Level,
+		PixFmt:  s.PixFmt,
+		Width:   s.Width,
+		Height:  s.Height,
+		FPS:     parseFrameRate(s.AvgFrameRate),
+	}, nil
+}
+
+// parseFrameRate reads ffprobe's "30000/1001" style rates
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type encodeMode int
+
+const (
+	// encodeLive is the real-time fallback with the full overlay
+	encodeLive encodeMode = iota
+	// encodeCache pre-transcodes library items, the clock can't be baked in
+	encodeCache
+	// encodeClip prepares ads and idents without any overlay
+	encodeClip
+)
+
+// encodeVersion prefixes the cache profiles of the arguments encodeArgs
+// builds. Bump it when they change so stale cache entries are not published.
+const encodeVersion = "v2"
+
+// encodeArgs builds the ffmpeg arguments that turn input into HLS segments.
+// Live encodes, cache entries and clips share them so they splice cleanly.
+// Sources that already match the channel's profile are only remuxed.
+func (ch *Channel) encodeArgs(input string, mode encodeMode, outputDir string, threads int) []string {
+	video, _ := probeVideo(input)
+	copyVideo := ch.canCopyVideo(video, input, mode)
+	fps := ch.profile.outputFPS(video.FPS)
+
+	filter := "[in]"
+	if mode != encodeClip {
+		if burn := ch.burnSubtitleFilter(input); burn != "" {
+			filter += burn + ","
+		}
+	}
+	filter += ch.profile.scaleFilter()
+	if fps != video.FPS {
+		filter += ",fps=" + strconv.FormatFloat(fps, 'f', -1, 64)
+	}
+	if mode != encodeClip {
+		filter += ch.overlayFilter()
+	}
+	if mode == encodeLive {
+		filter += clockFilter
+	}
+	filter += "[out]"
+
+	args := []string{"-nostdin", "-y"}
+	if mode == encodeLive {
+		args = append(args, "-re")
+	}
+	args = append(args, "-i", input)
+
+	extraInputs, audioMaps := ch.audioInputs(input, mode)
+	args = append(args, extraInputs...)
+	args = append(args, "-map", "0:v:0")
+	for _, m := range audioMaps {
+		args = append(args, "-map", m)
+	}
+	if len(extraInputs) > 0 {
+		args = append(args, "-shortest")
+	}
+
+	if copyVideo {
+		// Segments can only be cut at the source's own keyframes
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-vf", filter)
+		args = append(args, ch.videoCodecArgs(fps)...)
+	}
+	return append(args, ch.hlsOutputArgs(mode, outputDir, threads)...)
+}
+
+// overlayFilter draws the channel overlay text
+func (ch *Channel) overlayFilter() string {
+	if ch.config.Overlay == "" {
+		return ""
+	}
+	return ",drawtext=fontsize=25:fontcolor=white:expansion=none:text=" + escapeFilterValue(ch.config.Overlay) + ":x=25:y=25"
+}
+
+// clockFilter draws the local time under the overlay
+const clockFilter = `,drawtext=fontsize=18:fontcolor=white:text='%{localtime\:%T}':x=25:y=55`
+
+// hlsOutputArgs are the audio codec and HLS muxer arguments every encode
+// of the channel ends with, so all of them have the same track layout.
+// Audio is always encoded, it is cheap next to the video.
+func (ch *Channel) hlsOutputArgs(mode encodeMode, outputDir string, threads int) []string {
+	args := []string{
+		"-c:a", ch.profile.AudioCodec,
+		"-b:a", strconv.Itoa(ch.profile.AudioBitrateKbps) + "k",
+		"-ar", "48000",
+		"-ac", "2",
+	}
+	if threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(threads))
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(ch.config.SegmentTime),
+		"-hls_list_size", "0",
+	)
+	if mode != encodeLive {
+		args = append(args, "-hls_playlist_type", "vod")
+	}
+
+	// CMAF segments can be listed by the HLS and the DASH manifest alike
+	ext := ".ts"
+	if ch.config.DASH {
+		ext = ".m4s"
+		initName := "init.mp4"
+		if len(ch.audioRenditions) > 0 {
+			initName = "init_%v.mp4"
+		}
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", initName)
+	}
+
+	if len(ch.audioRenditions) == 0 {
+		return append(args,
+			"-hls_segment_filename", filepath.Join(outputDir, "seg%05d"+ext),
+			filepath.Join(outputDir, "index.m3u8"),
+		)
+	}
+
+	// Video and every audio rendition go to their own playlist
+	streamMap := "v:0,agroup:aud"
+	for i, r := range ch.audioRenditions {
+		streamMap += fmt.Sprintf(" a:%d,agroup:aud,language:%s", i, r.language)
+	}
+	return append(args,
+		"-var_stream_map", streamMap,
+		"-hls_segment_filename", filepath.Join(outputDir, "seg%v_%05d"+ext),
+		filepath.Join(outputDir, "index_%v.m3u8"),
+	)
+}
+
+// trackPlaylists returns the playlist of every track an encode writes to
+// dir, in the order of programOutput.tracks
+func (ch *Channel) trackPlaylists(dir string) []string {
+	if len(ch.audioRenditions) == 0 {
+		return []string{filepath.Join(dir, "index.m3u8")}
+	}
+
+	playlists := []string{}
+	for i := 0; i <= len(ch.audioRenditions); i++ {
+		playlists = append(playlists, filepath.Join(dir, fmt.Sprintf("index_%d.m3u8", i)))
+	}
+	return playlists
+}
+
+// readTrackSets loads the segment set of every track in dir
+func (ch *Channel) readTrackSets(dir string) ([]*SegmentSet, error) {
+	sets := []*SegmentSet{}
+	for _, path := range ch.trackPlaylists(dir) {
+		set, err := readSegmentSet(path)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// programOutput is where the segments of one program go: the video
+// playlist, the audio renditions, and the subtitle renditions that follow
+// the video segment by segment
+type programOutput struct {
+	ch        *Channel
+	tracks    []*LivePlaylist
+	subtitles []*subtitleRendition
+	offset    float64
+	// origin is the program time the encode's timestamps start from,
+	// non-zero when a live encode seeks into the program
+	origin float64
+}
+
+// beginOutput starts a new timeline and period in every playlist and
+// loads the subtitles of videoPath, pass "" for clips without subtitles
+func (ch *Channel) beginOutput(videoPath string) *programOutput {
+	ch.mutex.Lock()
+	ch.periods++
+	period := ch.periods
+	ch.mutex.Unlock()
+
+	out := &programOutput{ch: ch, tracks: []*LivePlaylist{ch.playlist}, subtitles: ch.subtitleRenditions}
+	for _, r := range ch.audioRenditions {
+		out.tracks = append(out.tracks, r.playlist)
+	}
+	for _, pl := range out.tracks {
+		pl.Discontinuity(period)
+	}
+
+	var tracks []SubtitleTrack
+	if videoPath != "" && len(out.subtitles) > 0 {
+		tracks = findSubtitles(videoPath)
+	}
+	for _, s := range out.subtitles {
+		s.playlist.Discontinuity(period)
+		s.load(videoPath, tracks)
+	}
+	return out
+}
+
+// seek is for programs that start starts[track] seconds into their
+// segment sets
+func (o *programOutput) seek(starts []float64) {
+	o.offset = starts[0]
+	for track, pl := range o.tracks {
+		pl.SetMediaTime(starts[track])
+	}
+}
+
+// setInit publishes the fMP4 init segment of a track's segment set
+func (o *programOutput) setInit(track int, set *SegmentSet) error {
+	if set.Init == "" {
+		return nil
+	}
+	return o.tracks[track].SetInit(filepath.Join(set.Dir, set.Init))
+}
+
+// append publishes a segment of the given track
+func (o *programOutput) append(track int, src string, duration float64, move bool) error {
+	if err := o.tracks[track].Append(src, duration, move); err != nil {
+		return err
+	}
+	if o.ch.config.DASH {
+		if err := o.ch.writeDASHManifest(); err != nil {
+			log.Printf("[%s] Error writing DASH manifest: %v\n", o.ch.name, err)
+		}
+	}
+	if track != 0 {
+		return nil
+	}
+
+	for _, s := range o.subtitles {
+		if err := s.appendWindow(o.offset, duration, o.origin); err != nil {
+			log.Printf("Error publishing %s subtitles: %v\n", s.language, err)
+		}
+	}
+	o.offset += duration
+	return nil
+}
+
+// publishEncoder runs a live ffmpeg encode into a scratch folder and moves
+// every finished segment into the playlists as soon as ffmpeg lists it.
+// The encode starts start seconds into the input.
+func (ch *Channel) publishEncoder(ctx context.Context, out *programOutput, input string, start float64) error {
+	args := ch.encodeArgs(input, encodeLive, ch.liveDir(), 0)
+	if start > 0 {
+		// An input option, so it seeks the program and not the silent track
+		args = append([]string{"-ss", strconv.FormatFloat(start, 'f', 3, 64)}, args...)
+		out.offset = start
+		out.origin = start
+	}
+	return ch.publishFFmpeg(ctx, out, args)
+}
+
+// liveDir is the scratch folder of live encodes
+func (ch *Channel) liveDir() string {
+	return filepath.Join(ch.workDir, "live")
+}
+
+// publishFFmpeg runs an ffmpeg encode writing to liveDir and publishes its
+// segments as they are finished
+func (ch *Channel) publishFFmpeg(ctx context.Context, out *programOutput, args []string) error {
+	workDir := ch.liveDir()
+	os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	cmd := ffmpegCommand(ctx, "ffmpeg", args...)
+	stderr := &stderrTail{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return classifyFailure(err, "")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- classifyFailure(cmd.Wait(), stderr.String())
+	}()
+
+	playlists := ch.trackPlaylists(workDir)
+	published := make([]int, len(playlists))
+	drain := func() {
+		for track, path := range playlists {
+			set, err := readSegmentSet(path)
+			if err != nil {
+				continue
+			}
+			if published[track] == 0 && len(set.Segments) > 0 {
+				if err := out.setInit(track, set); err != nil {
+					log.Printf("[%s] Error publishing segment: %v", ch.name, err)
+				}
+			}
+			for ; published[track] < len(set.Segments); published[track]++ {
+				seg := set.Segments[published[track]]
+				if err := out.append(track, filepath.Join(workDir, seg.Name), seg.Duration, true); err != nil {
+					log.Printf("[%s] Error publishing segment: %v", ch.name, err)
+				}
+			}
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			drain()
+		case err := <-done:
+			drain()
+			return err
+		}
+	}
+}
+
+// publishSegmentSets splices pre-encoded tracks into the playlists,
+// releasing each segment once its duration has elapsed like a live encoder
+// would. Nothing is re-encoded.
+func publishSegmentSets(ctx context.Context, out *programOutput, sets []*SegmentSet) error {
+	for track, set := range sets {
+		if err := out.setInit(track, set); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	next := make([]int, len(sets))
+	ends := make([]float64, len(sets))
+
+	for {
+		// Release the segment that ends first across all tracks
+		track := -1
+		for i, set := range sets {
+			if next[i] >= len(set.Segments) {
+				continue
+			}
+			end := ends[i] + set.Segments[next[i]].Duration
+			if track < 0 || end < ends[track]+sets[track].Segments[next[track]].Duration {
+				track = i
+			}
+		}
+		if track < 0 {
+			return nil
+		}
+
+		seg := sets[track].Segments[next[track]]
+		ends[track] += seg.Duration
+		next[track]++
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(time.Duration(ends[track] * float64(time.Second))))):
+		}
+
+		if err := out.append(track, filepath.Join(sets[track].Dir, seg.Name), seg.Duration, false); err != nil {
+			return err
+		}
+	}
+}
+
+// appendSegmentSets publishes pre-encoded tracks right away instead of
+// pacing them in real time
+func appendSegmentSets(out *programOutput, sets []*SegmentSet) error {
+	for track, set := range sets {
+		if err := out.setInit(track, set); err != nil {
+			return err
+		}
+		for _, seg := range set.Segments {
+			if err := out.append(track, filepath.Join(set.Dir, seg.Name), seg.Duration, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipSegments drops the segments of every track that end before offset
+// seconds into the program. It returns the trimmed sets and where each of
+// them starts now.
+func skipSegments(sets []*SegmentSet, offset float64) ([]*SegmentSet, []float64) {
+	trimmed := []*SegmentSet{}
+	starts := []float64{}
+	for _, set := range sets {
+		end := 0.0
+		i := 0
+		for ; i < len(set.Segments) && end+set.Segments[i].Duration <= offset; i++ {
+			end += set.Segments[i].Duration
+		}
+		trimmed = append(trimmed, &SegmentSet{Dir: set.Dir, Segments: set.Segments[i:], Ended: set.Ended, Init: set.Init})
+		starts = append(starts, end)
+	}
+	return trimmed, starts
+}
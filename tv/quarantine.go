@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons an ffmpeg run failed for
+const (
+	failureMissing     = "missing"
+	failureCorrupt     = "corrupt"
+	failureUnsupported = "unsupported"
+	failurePermission  = "permission"
+	failureResources   = "resources"
+	failureKilled      = "killed"
+	failureEnvironment = "environment"
+	failureError       = "error"
+)
+
+// failurePatterns maps ffmpeg messages to a reason, checked in order
+var failurePatterns = []struct {
+	pattern string
+	reason  string
+}{
+	{"no such file or directory", failureMissing},
+	{"permission denied", failurePermission},
+	{"cannot allocate memory", failureResources},
+	{"no space left on device", failureResources},
+	{"decoder not found", failureUnsupported},
+	{"unsupported codec", failureUnsupported},
+	{"not currently supported", failureUnsupported},
+	{"invalid data found when processing input", failureCorrupt},
+	{"moov atom not found", failureCorrupt},
+	{"could not find codec parameters", failureCorrupt},
+	{"invalid nal unit", failureCorrupt},
+	{"error while decoding", failureCorrupt},
+	{"corrupt", failureCorrupt},
+}
+
+// ffmpegError is a failed ffmpeg run with the reason it failed for and the
+// last line it wrote to stderr
+type ffmpegError struct {
+	Reason string
+	Detail string
+	err    error
+}
+
+func (e *ffmpegError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s: %v", e.Reason, e.err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Reason, e.err, e.Detail)
+}
+
+func (e *ffmpegError) Unwrap() error {
+	return e.err
+}
+
+// sourceFault tells whether the source file is to blame. Running out of
+// memory or being killed says nothing about the file.
+func (e *ffmpegError) sourceFault() bool {
+	switch e.Reason {
+	case failureCorrupt, failureUnsupported, failureError:
+		return true
+	}
+	return false
+}
+
+// stderrTail keeps the end of what ffmpeg writes to stderr, which is where
+// it explains why it gave up
+type stderrTail struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+const stderrTailSize = 8 << 10
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTailSize {
+		t.buf = t.buf[len(t.buf)-stderrTailSize:]
+	}
+	return len(p), nil
+}
+
+func (t *stderrTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// classifyFailure turns the error of an ffmpeg run and its stderr into an
+// ffmpegError. It returns nil for a nil error.
+func classifyFailure(err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+
+	ferr := &ffmpegError{Reason: failureError, err: err}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	ferr.Detail = strings.TrimSpace(lines[len(lines)-1])
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		ferr.Reason = failureEnvironment
+		return ferr
+	case errors.As(err, &exitErr) && !exitErr.Exited():
+		ferr.Reason = failureKilled
+		return ferr
+	}
+
+	lower := strings.ToLower(stderr)
+	for _, p := range failurePatterns {
+		if strings.Contains(lower, p.pattern) {
+			ferr.Reason = p.reason
+			break
+		}
+	}
+	return ferr
+}
+
+// QuarantineEntry is a source that failed to play
+type QuarantineEntry struct {
+	Path        string    `json:"path"`
+	Reason      string    `json:"reason"`
+	Detail      string    `json:"detail"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// Quarantine keeps sources that failed repeatedly out of playout and the
+// transcode cache. Quarantined entries are saved to disk so a restart
+// doesn't try them again, failure counts only live in memory.
+type Quarantine struct {
+	mu       sync.Mutex
+	path     string
+	limit    int
+	failures map[string]*QuarantineEntry
+	entries  map[string]*QuarantineEntry
+}
+
+func NewQuarantine(path string, limit int) *Quarantine {
+	if limit < 1 {
+		limit = 1
+	}
+	q := &Quarantine{
+		path:     path,
+		limit:    limit,
+		failures: map[string]*QuarantineEntry{},
+		entries:  map[string]*QuarantineEntry{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return q
+	}
+	entries := []*QuarantineEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Error reading quarantine list: %v\n", err)
+		return q
+	}
+	for _, e := range entries {
+		q.entries[e.Path] = e
+	}
+	return q
+}
+
+// Has tells whether path is quarantined
+func (q *Quarantine) Has(path string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.entries[path] != nil
+}
+
+// RecordFailure counts a failed run of path and quarantines it once it
+// failed often enough in a row. It returns true when path got quarantined.
+func (q *Quarantine) RecordFailure(path string, ferr *ffmpegError) bool {
+	if !ferr.sourceFault() {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.failures[path]
+	if e == nil {
+		e = &QuarantineEntry{Path: path}
+		q.failures[path] = e
+	}
+	e.Failures++
+	e.Reason = ferr.Reason
+	e.Detail = ferr.Detail
+	e.LastFailure = time.Now()
+
+	if e.Failures < q.limit || q.entries[path] != nil {
+		return false
+	}
+	delete(q.failures, path)
+	q.entries[path] = e
+	q.save()
+	return true
+}
+
+// RecordSuccess clears the failure count of path
+func (q *Quarantine) RecordSuccess(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.failures, path)
+}
+
+// List returns the quarantined entries, most recent failure first
+func (q *Quarantine) List() []QuarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := []QuarantineEntry{}
+	for _, e := range q.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastFailure.After(list[j].LastFailure)
+	})
+	return list
+}
+
+// Release lets path play again. It returns false when it wasn't quarantined.
+func (q *Quarantine) Release(path string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.entries[path] == nil {
+		return false
+	}
+	delete(q.entries, path)
+	q.save()
+	return true
+}
+
+// save writes the quarantined entries, the caller must hold q.mu
+func (q *Quarantine) save() {
+	list := []*QuarantineEntry{}
+	for _, e := range q.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving quarantine list: %v\n", err)
+	}
+}
+
+// maxBackoff caps the pause between programs after repeated failures
+const maxBackoff = time.Minute
+
+// FailureSummary is the playout failure history of a channel
+type FailureSummary struct {
+	Consecutive int              `json:"consecutive"`
+	Total       int              `json:"total"`
+	Quarantined int              `json:"quarantined"`
+	Last        *QuarantineEntry `json:"last"`
+}
+
+// recordFailure logs a failed program, counts it towards quarantine and
+// returns how long playout should pause before the next program
+func (ch *Channel) recordFailure(path string, err error) time.Duration {
+	var ferr *ffmpegError
+	if !errors.As(err, &ferr) {
+		// Publishing a cached rendition failed, not the source
+		ferr = &ffmpegError{Reason: failureEnvironment, err: err}
+	}
+	log.Printf("[%s] FFmpeg error: %v\n", ch.name, ferr)
+	if quarantine.RecordFailure(path, ferr) {
+		log.Printf("[%s] Quarantined %s after repeated failures\n", ch.name, path)
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.failures.Consecutive++
+	ch.failures.Total++
+	ch.failures.Last = &QuarantineEntry{
+		Path:        path,
+		Reason:      ferr.Reason,
+		Detail:      ferr.Detail,
+		Failures:    ch.failures.Consecutive,
+		LastFailure: time.Now(),
+	}
+
+	// The first failure is likely the file, more in a row suggest the
+	// machine, so wait twice as long after each of them
+	if ch.failures.Consecutive < 2 {
+		return 0
+	}
+	delay := time.Second << (ch.failures.Consecutive - 2)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// recordSuccess resets the failure streak after a program played through
+func (ch *Channel) recordSuccess(path string) {
+	quarantine.RecordSuccess(path)
+	ch.mutex.Lock()
+	ch.failures.Consecutive = 0
+	ch.mutex.Unlock()
+}
+
+func quarantineListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, quarantine.List())
+}
+
+func quarantineReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	if !quarantine.Release(req.Path) {
+		writeError(w, http.StatusNotFound, "no such file in quarantine")
+		return
+	}
+	log.Printf("Released from quarantine: %s\n", req.Path)
+	writeJSON(w, http.StatusOK, quarantine.List())
+}
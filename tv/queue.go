@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type QueueItem struct {
+	Index   int    `json:"index"`
+	File    string `json:"file"`
+	Title   string `json:"title"`
+	Poster  string `json:"poster,omitempty"`
+	Playing bool   `json:"playing"`
+	Next    bool   `json:"next"`
+	// Skipped by playout until released from quarantine
+	Quarantined bool `json:"quarantined"`
+}
+
+type QueueState struct {
+	Streaming  bool           `json:"streaming"`
+	Viewers    int            `json:"viewers"`
+	Hold       bool           `json:"hold"`
+	Fallback   bool           `json:"fallback"`
+	Failures   FailureSummary `json:"failures"`
+	Current    int            `json:"current"`
+	Next       int            `json:"next"`
+	NowPlaying *Program       `json:"nowPlaying"`
+	Items      []QueueItem    `json:"items"`
+}
+
+// queueState snapshots the queue, the caller must hold ch.mutex
+func (ch *Channel) queueState() QueueState {
+	state := QueueState{
+		Streaming: ch.isStreaming,
+		Viewers:   ch.viewerCount(),
+		Hold:      ch.hold,
+		Fallback:  ch.onFallback,
+		Failures:  ch.failures,
+		Current:   ch.playingIndex,
+		Next:      ch.currentIndex,
+		Items:     []QueueItem{},
+	}
+	if ch.nowPlaying.File != "" {
+		program := ch.nowPlaying
+		program.Poster, program.Preview = ch.thumbnailURLs(program.File)
+		state.NowPlaying = &program
+	}
+	state.Failures.Quarantined = len(quarantine.List())
+	for i, file := range ch.videoQueue {
+		poster, _ := ch.thumbnailURLs(file)
+		state.Items = append(state.Items, QueueItem{
+			Index:       i,
+			File:        file,
+			Title:       programTitle(file),
+			Poster:      poster,
+			Playing:     i == ch.playingIndex,
+			Next:        i == ch.currentIndex,
+			Quarantined: quarantine.Has(filepath.Join(ch.config.VideoFolder, file)),
+		})
+	}
+	return state
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeQueue responds with the queue after a successful operation
+func (ch *Channel) writeQueue(w http.ResponseWriter) {
+	ch.mutex.Lock()
+	state := ch.queueState()
+	ch.mutex.Unlock()
+	writeJSON(w, http.StatusOK, state)
+}
+
+// insertQueueItem puts file at pos, an item inserted at the next index
+// plays next. The caller must hold ch.mutex.
+func (ch *Channel) insertQueueItem(pos int, file string) {
+	if pos > len(ch.videoQueue) {
+		pos = len(ch.videoQueue)
+	}
+	ch.videoQueue = append(ch.videoQueue[:pos], append([]string{file}, ch.videoQueue[pos:]...)...)
+	if ch.playingIndex >= pos {
+		ch.playingIndex++
+	}
+	if ch.currentIndex > pos {
+		ch.currentIndex++
+	}
+}
+
+// removeQueueItem drops the item at index. The caller must hold ch.mutex.
+func (ch *Channel) removeQueueItem(index int) {
+	ch.videoQueue = append(ch.videoQueue[:index], ch.videoQueue[index+1:]...)
+	switch {
+	case ch.playingIndex == index:
+		ch.playingIndex = -1
+	case ch.playingIndex > index:
+		ch.playingIndex--
+	}
+	if ch.currentIndex > index {
+		ch.currentIndex--
+	}
+	if ch.currentIndex >= len(ch.videoQueue) {
+		ch.currentIndex = 0
+	}
+}
+
+// moveQueueItem moves the item at from to to. An item other than the
+// playing one moved onto the next index is inserted there, so it plays
+// next and the item that was next follows it. Otherwise the item that was
+// next stays next. The caller must hold ch.mutex.
+func (ch *Channel) moveQueueItem(from, to int) {
+	file := ch.videoQueue[from]
+	if to == ch.currentIndex && from != ch.playingIndex {
+		ch.removeQueueItem(from)
+		ch.insertQueueItem(ch.currentIndex, file)
+		return
+	}
+
+	ch.videoQueue = append(ch.videoQueue[:from], ch.videoQueue[from+1:]...)
+	ch.videoQueue = append(ch.videoQueue[:to], append([]string{file}, ch.videoQueue[to:]...)...)
+	if ch.playingIndex >= 0 {
+		ch.playingIndex = moveIndex(ch.playingIndex, from, to)
+	}
+	ch.currentIndex = moveIndex(ch.currentIndex, from, to)
+}
+
+// shuffleQueue puts the item that was at perm[i] at i. The playing item
+// keeps playing and whatever now follows it plays next. The caller must
+// hold ch.mutex.
+func (ch *Channel) shuffleQueue(perm []int) {
+	playing := ch.playingIndex
+	shuffled := make([]string, len(ch.videoQueue))
+	for newIndex, oldIndex := range perm {
+		shuffled[newIndex] = ch.videoQueue[oldIndex]
+		if oldIndex == playing {
+			ch.playingIndex = newIndex
+		}
+	}
+	ch.videoQueue = shuffled
+
+	// Carry on with whatever now follows the current program
+	ch.currentIndex = 0
+	if ch.playingIndex >= 0 && len(ch.videoQueue) > 0 {
+		ch.currentIndex = (ch.playingIndex + 1) % len(ch.videoQueue)
+	}
+}
+
+// jumpTo cuts the current program short and plays the item at index next,
+// in place of any program left to resume. The caller must hold ch.mutex.
+func (ch *Channel) jumpTo(index int) {
+	ch.currentIndex = index
+	ch.resume = nil
+	if ch.currentCancel != nil {
+		ch.currentCancel()
+	}
+}
+
+// moveIndex returns where the item at i ends up after moving from to to
+func moveIndex(i, from, to int) int {
+	switch {
+	case i == from:
+		return to
+	case from < to && i > from && i <= to:
+		return i - 1
+	case from > to && i >= to && i < from:
+		return i + 1
+	}
+	return i
+}
+
+func queueHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.writeQueue(w)
+}
+
+func jumpHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Index int `json:"index"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	ch.mutex.Lock()
+	if req.Index < 0 || req.Index >= len(ch.videoQueue) {
+		ch.mutex.Unlock()
+		writeError(w, http.StatusNotFound, "no such queue index")
+		return
+	}
+	ch.jumpTo(req.Index)
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
+
+func enqueueHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		File string `json:"file"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	// Only files from the library can be queued
+	file := filepath.Base(req.File)
+	info, err := os.Stat(filepath.Join(ch.config.VideoFolder, file))
+	if req.File == "" || err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "no such file in the library")
+		return
+	}
+
+	// Insert at the next position so it plays right after the current program
+	ch.mutex.Lock()
+	ch.insertQueueItem(ch.currentIndex, file)
+	ch.mutex.Unlock()
+
+	cache.Enqueue(ch, filepath.Join(ch.config.VideoFolder, file))
+	ch.writeQueue(w)
+}
+
+func moveHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	ch.mutex.Lock()
+	if req.From < 0 || req.From >= len(ch.videoQueue) || req.To < 0 || req.To >= len(ch.videoQueue) {
+		ch.mutex.Unlock()
+		writeError(w, http.StatusNotFound, "no such queue index")
+		return
+	}
+	ch.moveQueueItem(req.From, req.To)
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
+
+func removeHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+
+	ch.mutex.Lock()
+	if err != nil || index < 0 || index >= len(ch.videoQueue) {
+		ch.mutex.Unlock()
+		writeError(w, http.StatusNotFound, "no such queue index")
+		return
+	}
+	ch.removeQueueItem(index)
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
+
+func shuffleHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	ch.shuffleQueue(rand.Perm(len(ch.videoQueue)))
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
+
+func refillHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	var playingFile, nextFile string
+	if ch.playingIndex >= 0 && ch.playingIndex < len(ch.videoQueue) {
+		playingFile = ch.videoQueue[ch.playingIndex]
+	}
+	if ch.currentIndex < len(ch.videoQueue) {
+		nextFile = ch.videoQueue[ch.currentIndex]
+	}
+
+	ch.refillQueue()
+
+	// Keep the position by file name where the files still exist
+	ch.playingIndex = -1
+	ch.currentIndex = 0
+	for i, file := range ch.videoQueue {
+		if file == playingFile {
+			ch.playingIndex = i
+			ch.currentIndex = (i + 1) % len(ch.videoQueue)
+		}
+	}
+	for i, file := range ch.videoQueue {
+		if file == nextFile {
+			ch.currentIndex = i
+		}
+	}
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
+
+func apiStartHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.startStreaming()
+	ch.writeQueue(w)
+}
+
+func apiStopHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.stopStreaming()
+	ch.writeQueue(w)
+}
+
+func apiRestartHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.stopStreaming()
+	ch.startStreaming()
+	ch.writeQueue(w)
+}
+
+func apiSkipHandler(ch *Channel, w http.ResponseWriter, r *http.Request) {
+	ch.mutex.Lock()
+	if ch.currentCancel == nil {
+		ch.mutex.Unlock()
+		writeError(w, http.StatusConflict, "no video is currently playing")
+		return
+	}
+	ch.currentCancel()
+	ch.mutex.Unlock()
+
+	ch.writeQueue(w)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func testChannel(queue []string, playing, next int) *Channel {
+	return &Channel{videoQueue: append([]string(nil), queue...), playingIndex: playing, currentIndex: next}
+}
+
+// checkQueue fails unless the queue holds want with the given playing and
+// next items
+func checkQueue(t *testing.T, ch *Channel, want []string, playing, next int) {
+	t.Helper()
+	if !reflect.DeepEqual(ch.videoQueue, want) {
+		t.Fatalf("queue is %v, want %v", ch.videoQueue, want)
+	}
+	if ch.playingIndex != playing || ch.currentIndex != next {
+		t.Fatalf("playing %d, next %d, want %d and %d", ch.playingIndex, ch.currentIndex, playing, next)
+	}
+}
+
+func TestShuffleQueueKeepsPlaying(t *testing.T) {
+	queue := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 2000; i++ {
+		playing := rand.Intn(len(queue))
+		ch := testChannel(queue, playing, (playing+1)%len(queue))
+		ch.shuffleQueue(rand.Perm(len(queue)))
+
+		if ch.playingIndex < 0 || ch.videoQueue[ch.playingIndex] != queue[playing] {
+			t.Fatalf("playing %s lost after shuffle to %v, index %d", queue[playing], ch.videoQueue, ch.playingIndex)
+		}
+		if ch.currentIndex != (ch.playingIndex+1)%len(queue) {
+			t.Fatalf("next is %d, want the item after playing %d", ch.currentIndex, ch.playingIndex)
+		}
+	}
+}
+
+func TestShuffleQueueChain(t *testing.T) {
+	// The playing item moves to 1 and the item moved to 2 was at 1, so a
+	// loop rewriting playingIndex as it goes would follow it a second time
+	ch := testChannel([]string{"a", "b", "c"}, 0, 1)
+	ch.shuffleQueue([]int{2, 0, 1})
+	checkQueue(t, ch, []string{"c", "a", "b"}, 1, 2)
+}
+
+func TestShuffleQueueNothingPlaying(t *testing.T) {
+	ch := testChannel([]string{"a", "b", "c"}, -1, 2)
+	ch.shuffleQueue([]int{1, 2, 0})
+	checkQueue(t, ch, []string{"b", "c", "a"}, -1, 0)
+}
+
+func TestMoveQueueItem(t *testing.T) {
+	queue := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name          string
+		from, to      int
+		want          []string
+		playing, next int
+	}{
+		{"later item to next", 3, 1, []string{"a", "d", "b", "c"}, 0, 1},
+		{"playing item to next", 0, 1, []string{"b", "a", "c", "d"}, 1, 0},
+		{"later item forward", 3, 2, []string{"a", "b", "d", "c"}, 0, 1},
+		{"next item back", 1, 3, []string{"a", "c", "d", "b"}, 0, 3},
+		{"playing item", 0, 2, []string{"b", "c", "a", "d"}, 2, 0},
+		{"before playing", 3, 0, []string{"d", "a", "b", "c"}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := testChannel(queue, 0, 1)
+			ch.moveQueueItem(tt.from, tt.to)
+			checkQueue(t, ch, tt.want, tt.playing, tt.next)
+		})
+	}
+
+	// An earlier item moved onto the next index plays next too, and the
+	// item that was next still follows
+	ch := testChannel(queue, 1, 2)
+	ch.moveQueueItem(0, 2)
+	checkQueue(t, ch, []string{"b", "a", "c", "d"}, 0, 1)
+	if after := ch.videoQueue[ch.currentIndex+1]; after != "c" {
+		t.Fatalf("%s plays after the moved item, want c", after)
+	}
+}
+
+func TestRemoveQueueItem(t *testing.T) {
+	queue := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name          string
+		index         int
+		want          []string
+		playing, next int
+	}{
+		{"before playing", 0, []string{"b", "c", "d"}, 0, 1},
+		{"playing", 1, []string{"a", "c", "d"}, -1, 1},
+		{"next", 2, []string{"a", "b", "d"}, 1, 2},
+		{"last while next", 3, []string{"a", "b", "c"}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := testChannel(queue, 1, 2)
+			ch.removeQueueItem(tt.index)
+			checkQueue(t, ch, tt.want, tt.playing, tt.next)
+		})
+	}
+
+	// Removing the last item while it is next wraps to the start
+	ch := testChannel(queue, 2, 3)
+	ch.removeQueueItem(3)
+	checkQueue(t, ch, []string{"a", "b", "c"}, 2, 0)
+}
+
+func TestInsertQueueItem(t *testing.T) {
+	queue := []string{"a", "b", "c"}
+	tests := []struct {
+		name          string
+		pos           int
+		want          []string
+		playing, next int
+	}{
+		{"at next plays next", 2, []string{"a", "b", "x", "c"}, 1, 2},
+		{"before playing", 0, []string{"x", "a", "b", "c"}, 2, 3},
+		{"at playing", 1, []string{"a", "x", "b", "c"}, 2, 3},
+		{"past the end", 9, []string{"a", "b", "c", "x"}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := testChannel(queue, 1, 2)
+			ch.insertQueueItem(tt.pos, "x")
+			checkQueue(t, ch, tt.want, tt.playing, tt.next)
+		})
+	}
+}
+
+func TestJumpClearsResume(t *testing.T) {
+	ch := testChannel([]string{"a", "b", "c"}, 0, 1)
+	ch.resume = &resumePoint{program: Program{File: "a"}, index: 0, offset: 30}
+	cancelled := false
+	ch.currentCancel = func() { cancelled = true }
+
+	ch.jumpTo(2)
+	if ch.resume != nil {
+		t.Fatal("resume point survived a jump and would play instead")
+	}
+	if !cancelled {
+		t.Fatal("jump didn't cut the current program")
+	}
+	checkQueue(t, ch, []string{"a", "b", "c"}, 0, 2)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Slot is a fixed daily program. When its time comes the slot's file is
+// played right after the current program instead of the next queue item.
+type Slot struct {
+	At    string `json:"at"`
+	File  string `json:"file"`
+	Title string `json:"title"`
+}
+
+// Program is a scheduled item of the channel
+type Program struct {
+	Title     string    `json:"title"`
+	File      string    `json:"file"`
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+	Scheduled bool      `json:"scheduled"`
+	// Poster frame and seek preview track, once generated
+	Poster  string `json:"poster,omitempty"`
+	Preview string `json:"preview,omitempty"`
+}
+
+// maxGuideEntries caps the projection for libraries of very short videos
+const maxGuideEntries = 500
+
+// maxScheduleSteps caps how many programs are walked through to find the
+// one on air, for channels that idled for a long time
+const maxScheduleSteps = 10000
+
+// dueSlot returns the first slot whose daily time falls in (from, to]
+func dueSlot(slots []Slot, from, to time.Time) *Slot {
+	for i := range slots {
+		at, err := time.ParseInLocation("15:04", slots[i].At, to.Location())
+		if err != nil {
+			continue
+		}
+
+		// Check today and yesterday so ranges across midnight are covered
+		for _, day := range []time.Time{to, to.AddDate(0, 0, -1)} {
+			t := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, to.Location())
+			if t.After(from) && !t.After(to) {
+				return &slots[i]
+			}
+		}
+	}
+	return nil
+}
+
+// programTitle turns a file name into something readable for the guide
+func programTitle(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	name = strings.NewReplacer("_", " ", ".", " ").Replace(name)
+	return strings.TrimSpace(name)
+}
+
+// itemDuration is the length of a library item, preferring the cached
+// rendition over asking ffprobe
+func (ch *Channel) itemDuration(file string) float64 {
+	path := filepath.Join(ch.config.VideoFolder, file)
+	if sets, ok := cache.Lookup(ch, path); ok {
+		return sets[0].Total()
+	}
+	duration, err := probeDuration(path)
+	if err != nil {
+		return 0
+	}
+	return duration
+}
+
+// scheduleCursor walks the queue and the programming slots the same way
+// playout picks its next program
+type scheduleCursor struct {
+	queue  []string
+	index  int
+	slots  []Slot
+	picked time.Time
+}
+
+// scheduleCursor snapshots the picking state, the caller must hold ch.mutex
+func (ch *Channel) scheduleCursor() *scheduleCursor {
+	return &scheduleCursor{
+		queue:  append([]string(nil), ch.videoQueue...),
+		index:  ch.currentIndex,
+		slots:  ch.config.Programming,
+		picked: ch.lastPick,
+	}
+}
+
+// next returns the program picked at the given time and the queue index it
+// came from, -1 for slots. It returns false when there is nothing to play.
+func (c *scheduleCursor) next(at time.Time) (Program, int, bool) {
+	if c.picked.IsZero() {
+		c.picked = at
+	}
+
+	var program Program
+	index := -1
+	if slot := dueSlot(c.slots, c.picked, at); slot != nil {
+		program = Program{Title: slot.Title, File: slot.File, Scheduled: true}
+	} else if len(c.queue) > 0 {
+		if c.index >= len(c.queue) {
+			c.index = 0
+		}
+		index = c.index
+		program = Program{File: c.queue[index]}
+		c.index = (c.index + 1) % len(c.queue)
+	} else {
+		return Program{}, -1, false
+	}
+	if program.Title == "" {
+		program.Title = programTitle(program.File)
+	}
+	c.picked = at
+	return program, index, true
+}
+
+// projectSchedule predicts the programs from the current one until the
+// horizon, following the same rules playout uses to pick the next item.
+// Programs that already ended while an on-demand channel was idle are
+// left out.
+func (ch *Channel) projectSchedule(horizon time.Time) []Program {
+	ch.mutex.Lock()
+	current := ch.nowPlaying
+	cursor := ch.scheduleCursor()
+	ch.mutex.Unlock()
+
+	now := time.Now()
+	programs := []Program{}
+	next := now
+	if current.File != "" {
+		if current.Stop.After(now) {
+			programs = append(programs, current)
+		}
+		next = current.Stop
+	}
+	skipped := 0
+
+	for steps := 0; next.Before(horizon) && len(programs) < maxGuideEntries && steps < maxScheduleSteps; steps++ {
+		program, _, ok := cursor.next(next)
+		if !ok {
+			break
+		}
+
+		duration := ch.itemDuration(program.File)
+		if duration <= 0 {
+			// Unknown length, the file is likely unplayable
+			skipped++
+			if skipped > len(cursor.queue) {
+				break
+			}
+			continue
+		}
+		skipped = 0
+
+		program.Start = next
+		program.Stop = next.Add(time.Duration(duration * float64(time.Second)))
+		if program.Stop.After(now) {
+			programs = append(programs, program)
+		}
+		next = program.Stop
+	}
+
+	return programs
+}
+
+// resumePoint is where playout picks up after an on-demand channel idled
+type resumePoint struct {
+	program Program
+	index   int
+	offset  float64
+}
+
+// catchUp moves an idled channel to the program the schedule says is on
+// now, so playout resumes as if it had been running all along
+func (ch *Channel) catchUp(now time.Time) {
+	ch.mutex.Lock()
+	if !ch.parked {
+		ch.mutex.Unlock()
+		return
+	}
+	ch.parked = false
+	current := ch.nowPlaying
+	index := ch.parkedIndex
+	cursor := ch.scheduleCursor()
+	ch.mutex.Unlock()
+
+	if current.File == "" {
+		return
+	}
+
+	skipped := 0
+	for steps := 0; !current.Stop.After(now); steps++ {
+		if steps >= maxScheduleSteps {
+			return
+		}
+		program, i, ok := cursor.next(current.Stop)
+		if !ok {
+			return
+		}
+		duration := ch.itemDuration(program.File)
+		if duration <= 0 {
+			skipped++
+			if skipped > len(cursor.queue) {
+				return
+			}
+			continue
+		}
+		skipped = 0
+
+		program.Start = current.Stop
+		program.Stop = program.Start.Add(time.Duration(duration * float64(time.Second)))
+		current = program
+		index = i
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	// The queue may have changed while durations were probed
+	if index >= len(ch.videoQueue) || (index >= 0 && ch.videoQueue[index] != current.File) {
+		index = -1
+	}
+	ch.currentIndex = cursor.index
+	ch.lastPick = cursor.picked
+	ch.resume = &resumePoint{program: current, index: index, offset: now.Sub(current.Start).Seconds()}
+	log.Printf("[%s] Resuming %s at %.0fs\n", ch.name, current.File, ch.resume.offset)
+}
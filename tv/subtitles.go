@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	subtitlesOff    = "off"
+	subtitlesBurn   = "burn"
+	subtitlesWebVTT = "webvtt"
+)
+
+type SubtitleConfig struct {
+	Mode      string   `json:"mode"`
+	Languages []string `json:"languages"`
+}
+
+// SubtitleTrack is an embedded subtitle stream or a sidecar file
+type SubtitleTrack struct {
+	Language string
+	Codec    string
+	// Sidecar is the path of an external file, empty for embedded streams
+	Sidecar string
+	// Stream is the subtitle stream number for -map 0:s:N
+	Stream int
+}
+
+// textSubtitleCodecs can be converted to WebVTT or rendered by libass.
+// Bitmap formats like PGS and DVD subtitles are ignored.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// mpegtsStartPTS is where ffmpeg's mpegts muxer starts the timestamps of
+// every encode, subtitle segments are mapped onto it. fMP4 encodes start
+// at zero.
+const mpegtsStartPTS = 126000
+
+// findSubtitles lists the text subtitle streams of a video followed by
+// sidecar files next to it, like movie.srt or movie.en.ass
+func findSubtitles(videoPath string) []SubtitleTrack {
+	tracks := []SubtitleTrack{}
+
+	streams, err := probeStreams(videoPath, "s")
+	if err == nil {
+		for _, s := range streams {
+			if textSubtitleCodecs[s.Codec] {
+				tracks = append(tracks, SubtitleTrack{Language: s.Language, Codec: s.Codec, Stream: s.TypeIndex})
+			}
+		}
+	}
+
+	// Not a glob, video names often have brackets in them
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext != ".srt" && ext != ".ass" && ext != ".ssa" && ext != ".vtt" {
+			continue
+		}
+		// The part between the video name and the extension is the language
+		lang := strings.TrimPrefix(strings.TrimSuffix(name, filepath.Ext(name)), base)
+		lang = strings.TrimPrefix(lang, ".")
+		tracks = append(tracks, SubtitleTrack{Language: normalizeLanguage(lang), Codec: ext[1:], Sidecar: filepath.Join(dir, name)})
+	}
+
+	return tracks
+}
+
+// selectSubtitle picks the track for the first preferred language that is
+// available. Without preferences the first track wins.
+func selectSubtitle(tracks []SubtitleTrack, languages []string) *SubtitleTrack {
+	if len(tracks) == 0 {
+		return nil
+	}
+	if len(languages) == 0 {
+		return &tracks[0]
+	}
+	for _, lang := range languages {
+		lang = normalizeLanguage(lang)
+		for i := range tracks {
+			if tracks[i].Language == lang {
+				return &tracks[i]
+			}
+		}
+	}
+	return nil
+}
+
+// escapeFilterValue quotes a path for use inside an ffmpeg filter graph
+func escapeFilterValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return "'" + value + "'"
+}
+
+// burnSubtitleFilter returns the filter that renders the preferred
+// subtitle track into the picture, or "" when there is nothing to burn
+func (ch *Channel) burnSubtitleFilter(videoPath string) string {
+	if ch.config.Subtitles.Mode != subtitlesBurn {
+		return ""
+	}
+
+	track := selectSubtitle(findSubtitles(videoPath), ch.config.Subtitles.Languages)
+	if track == nil {
+		return ""
+	}
+	if track.Sidecar != "" {
+		return "subtitles=filename=" + escapeFilterValue(track.Sidecar)
+	}
+	return fmt.Sprintf("subtitles=filename=%s:si=%d", escapeFilterValue(videoPath), track.Stream)
+}
+
+// vttCue is a single subtitle cue, times are relative to the program start
+type vttCue struct {
+	Start float64
+	End   float64
+	Text  string
+}
+
+// subtitleRendition is one language of the WebVTT subtitle group. It gets
+// a segment for every video segment so both timelines stay aligned.
+type subtitleRendition struct {
+	language string
+	// firstTrack publishes the first text track whatever its language,
+	// when no languages are configured
+	firstTrack bool
+	playlist   *LivePlaylist
+	workDir    string
+	startPTS   int
+	cues       []vttCue
+	next       int
+}
+
+func (ch *Channel) newSubtitleRenditions() []*subtitleRendition {
+	if ch.config.Subtitles.Mode != subtitlesWebVTT {
+		return nil
+	}
+
+	startPTS := mpegtsStartPTS
+	if ch.config.DASH {
+		startPTS = 0
+	}
+
+	languages := ch.config.Subtitles.Languages
+	if len(languages) == 0 {
+		log.Printf("[%s] No subtitle languages configured, publishing the first text track of every video\n", ch.name)
+		return []*subtitleRendition{{
+			language:   "und",
+			firstTrack: true,
+			playlist:   ch.newPlaylist("subs_und.m3u8"),
+			workDir:    filepath.Join(ch.workDir, "subs"),
+			startPTS:   startPTS,
+		}}
+	}
+
+	renditions := []*subtitleRendition{}
+	for _, lang := range languages {
+		lang = normalizeLanguage(lang)
+		renditions = append(renditions, &subtitleRendition{
+			language: lang,
+			playlist: ch.newPlaylist("subs_" + lang + ".m3u8"),
+			workDir:  filepath.Join(ch.workDir, "subs"),
+			startPTS: startPTS,
+		})
+	}
+	return renditions
+}
+
+// load extracts the cues of this rendition's language from videoPath.
+// An empty path, as used for clips, clears the cues.
+func (s *subtitleRendition) load(videoPath string, tracks []SubtitleTrack) {
+	s.cues = nil
+	if videoPath == "" {
+		return
+	}
+
+	languages := []string{s.language}
+	if s.firstTrack {
+		languages = nil
+	}
+	track := selectSubtitle(tracks, languages)
+	if track == nil {
+		return
+	}
+
+	os.MkdirAll(s.workDir, os.ModePerm)
+	vttPath := filepath.Join(s.workDir, s.language+".vtt")
+
+	var cmd *exec.Cmd
+	if track.Sidecar != "" {
+		cmd = exec.Command("ffmpeg", "-nostdin", "-y", "-i", track.Sidecar, "-f", "webvtt", vttPath)
+	} else {
+		cmd = exec.Command("ffmpeg", "-nostdin", "-y", "-i", videoPath, "-map", fmt.Sprintf("0:s:%d", track.Stream), "-f", "webvtt", vttPath)
+	}
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error extracting %s subtitles from %s: %v\n", s.language, videoPath, err)
+		return
+	}
+
+	cues, err := readVTT(vttPath)
+	if err != nil {
+		log.Printf("Error reading subtitles %s: %v\n", vttPath, err)
+		return
+	}
+	s.cues = cues
+}
+
+// appendWindow publishes a WebVTT segment with the cues overlapping the
+// program time range [start, start+duration). origin is the program time
+// the video timestamps start from.
+func (s *subtitleRendition) appendWindow(start, duration, origin float64) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	fmt.Fprintf(&b, "X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n\n", s.startPTS, formatVTTTime(origin))
+	for _, cue := range s.cues {
+		if cue.End <= start || cue.Start >= start+duration {
+			continue
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", formatVTTTime(cue.Start), formatVTTTime(cue.End), cue.Text)
+	}
+
+	os.MkdirAll(s.workDir, os.ModePerm)
+	path := filepath.Join(s.workDir, fmt.Sprintf("%s-%d.vtt", s.language, s.next))
+	s.next++
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return s.playlist.Append(path, duration, true)
+}
+
+func readVTT(path string) ([]vttCue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cues := []vttCue{}
+	var cue *vttCue
+	var text []string
+
+	flush := func() {
+		if cue != nil && len(text) > 0 {
+			cue.Text = strings.Join(text, "\n")
+			cues = append(cues, *cue)
+		}
+		cue = nil
+		text = nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			flush()
+		case strings.Contains(line, "-->"):
+			flush()
+			from, to, _ := strings.Cut(line, "-->")
+			// Cue settings may follow the end time
+			fields := strings.Fields(to)
+			if len(fields) == 0 {
+				continue
+			}
+			start, err1 := parseVTTTime(strings.TrimSpace(from))
+			end, err2 := parseVTTTime(fields[0])
+			if err1 == nil && err2 == nil {
+				cue = &vttCue{Start: start, End: end}
+			}
+		case cue != nil:
+			text = append(text, line)
+		}
+	}
+	flush()
+
+	return cues, scanner.Err()
+}
+
+// parseVTTTime parses hh:mm:ss.mmm or mm:ss.mmm into seconds
+func parseVTTTime(value string) (float64, error) {
+	parts := strings.Split(value, ":")
+	seconds := 0.0
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+func formatVTTTime(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSubtitlesBracketedName(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Movie [1080p].mkv", "Movie [1080p].en.srt", "Movie [1080p].ass", "Movie [1080p].nfo", "Movie.srt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracks := findSubtitles(filepath.Join(dir, "Movie [1080p].mkv"))
+	want := []SubtitleTrack{
+		{Language: "und", Codec: "ass", Sidecar: filepath.Join(dir, "Movie [1080p].ass")},
+		{Language: normalizeLanguage("en"), Codec: "srt", Sidecar: filepath.Join(dir, "Movie [1080p].en.srt")},
+	}
+	if len(tracks) != len(want) {
+		t.Fatalf("found %v, want %v", tracks, want)
+	}
+	for i := range want {
+		if tracks[i] != want[i] {
+			t.Errorf("track %d is %+v, want %+v", i, tracks[i], want[i])
+		}
+	}
+}
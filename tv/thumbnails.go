@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Files generated for every library item
+const (
+	posterFile    = "poster.jpg"
+	spriteFile    = "sprite.jpg"
+	thumbnailsVTT = "thumbnails.vtt"
+)
+
+// Sprite sheet layout. Tiles keep the 4:3 picture of the channels, long
+// videos get a wider interval so the sheet never exceeds maxSpriteTiles.
+const (
+	spriteColumns  = 10
+	maxSpriteTiles = 100
+	tileWidth      = 160
+	tileHeight     = 120
+)
+
+// posterMinBrightness is the average luma a poster frame must exceed, it
+// keeps fades and black scene changes off the poster
+const posterMinBrightness = 32
+
+// Thumbnails generates the poster frame and seek preview sprite of library
+// items in the background. Entries are keyed by the same source hash as the
+// transcode cache, so renamed files keep their images.
+type Thumbnails struct {
+	dir      string
+	interval int
+	jobs     chan string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	pending  map[string]bool
+	// ready maps sources to the hash of their generated entry
+	ready map[string]string
+}
+
+func NewThumbnails(dir string, interval int) *Thumbnails {
+	if interval < 1 {
+		interval = 1
+	}
+	return &Thumbnails{
+		dir:      dir,
+		interval: interval,
+		jobs:     make(chan string, 1024),
+		pending:  map[string]bool{},
+		ready:    map[string]string{},
+	}
+}
+
+// Start launches the background worker
+func (t *Thumbnails) Start() {
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.wg.Add(1)
+	go t.worker()
+}
+
+// Stop terminates a running generation and waits for the worker to exit
+func (t *Thumbnails) Stop() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	t.wg.Wait()
+}
+
+// Enqueue schedules thumbnails for path unless they exist or are queued
+func (t *Thumbnails) Enqueue(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending[path] {
+		return
+	}
+	select {
+	case t.jobs <- path:
+		t.pending[path] = true
+	default:
+		// The queue is full, the item is picked up again on the next refill
+	}
+}
+
+// Ready returns the hash the thumbnails of path are served under, once the
+// worker generated or found them. It doesn't touch the disk, so it is cheap
+// enough to call while holding a channel lock.
+func (t *Thumbnails) Ready(path string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hash, ok := t.ready[path]
+	return hash, ok
+}
+
+// lookup returns the hash of the generated entry of path
+func (t *Thumbnails) lookup(path string) (string, bool) {
+	hash, err := cache.hash(path)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(t.dir, hash, thumbnailsVTT)); err != nil {
+		return "", false
+	}
+	return hash, true
+}
+
+func (t *Thumbnails) worker() {
+	defer t.wg.Done()
+
+	for {
+		var path string
+		select {
+		case <-t.ctx.Done():
+			return
+		case path = <-t.jobs:
+		}
+
+		hash, ok := t.lookup(path)
+		if !ok && !quarantine.Has(path) {
+			err := t.generate(path)
+			if err != nil && t.ctx.Err() == nil {
+				log.Printf("Error generating thumbnails for %s: %v\n", path, err)
+			}
+			hash, ok = t.lookup(path)
+		}
+
+		t.mu.Lock()
+		delete(t.pending, path)
+		if ok {
+			t.ready[path] = hash
+		} else {
+			delete(t.ready, path)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *Thumbnails) generate(path string) error {
+	hash, err := cache.hash(path)
+	if err != nil {
+		return err
+	}
+	duration, err := probeDuration(path)
+	if err != nil {
+		return err
+	}
+
+	entry := filepath.Join(t.dir, hash)
+	tmpDir := entry + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := t.generatePoster(path, duration, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := t.generateSprite(path, duration, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	os.RemoveAll(entry)
+	if err := os.Rename(tmpDir, entry); err != nil {
+		return err
+	}
+	log.Printf("Generated thumbnails for %s\n", path)
+	return nil
+}
+
+// generatePoster picks the first scene change after the opening that isn't
+// dark. Videos without a usable cut fall back to the most representative
+// frame ffmpeg's thumbnail filter finds there.
+func (t *Thumbnails) generatePoster(path string, duration float64, dir string) error {
+	output := filepath.Join(dir, posterFile)
+	start := strconv.FormatFloat(duration/10, 'f', 3, 64)
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", 2*tileWidth, 2*tileHeight)
+
+	filters := []string{
+		"select='gt(scene,0.3)',signalstats,metadata=mode=select:key=lavfi.signalstats.YAVG:value=" +
+			strconv.Itoa(posterMinBrightness) + ":function=greater," + scale,
+		"thumbnail=100," + scale,
+	}
+	for _, filter := range filters {
+		cmd := ffmpegCommand(t.ctx, "nice", "-n", "19", "ffmpeg", "-nostdin", "-y",
+			"-ss", start, "-t", "300", "-i", path,
+			"-an", "-sn",
+			"-vf", filter,
+			"-frames:v", "1",
+			"-q:v", "3",
+			output,
+		)
+		stderr := &stderrTail{}
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return classifyFailure(err, stderr.String())
+		}
+		if info, err := os.Stat(output); err == nil && info.Size() > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("no poster frame found")
+}
+
+// generateSprite tiles one frame per interval into a sprite sheet and
+// writes the WebVTT track that maps the timeline to its tiles
+func (t *Thumbnails) generateSprite(path string, duration float64, dir string) error {
+	interval := math.Max(float64(t.interval), duration/maxSpriteTiles)
+	tiles := int(math.Ceil(duration / interval))
+	if tiles < 1 {
+		tiles = 1
+	}
+	columns := spriteColumns
+	if tiles < columns {
+		columns = tiles
+	}
+	rows := (tiles + columns - 1) / columns
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		strconv.FormatFloat(interval, 'f', 3, 64), tileWidth, tileHeight, tileWidth, tileHeight, columns, rows)
+	// Decoding keyframes only is plenty for previews and much faster
+	cmd := ffmpegCommand(t.ctx, "nice", "-n", "19", "ffmpeg", "-nostdin", "-y",
+		"-skip_frame", "nokey", "-i", path,
+		"-an", "-sn",
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "5",
+		filepath.Join(dir, spriteFile),
+	)
+	stderr := &stderrTail{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return classifyFailure(err, stderr.String())
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; i < tiles; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, duration)
+		fmt.Fprintf(&b, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTime(start), formatVTTTime(end), spriteFile,
+			(i%columns)*tileWidth, (i/columns)*tileHeight, tileWidth, tileHeight)
+	}
+	return os.WriteFile(filepath.Join(dir, thumbnailsVTT), []byte(b.String()), 0644)
+}
+
+// thumbnailURLs returns the poster and preview track URLs of a library
+// item, empty while they are not generated yet
+func (ch *Channel) thumbnailURLs(file string) (poster string, preview string) {
+	hash, ok := thumbnails.Ready(filepath.Join(ch.config.VideoFolder, file))
+	if !ok {
+		return "", ""
+	}
+	return "/thumbnails/" + hash + "/" + posterFile, "/thumbnails/" + hash + "/" + thumbnailsVTT
+}
+
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	file := r.PathValue("file")
+	if hash == "" || strings.Trim(hash, "0123456789abcdef") != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch file {
+	case posterFile, spriteFile:
+		w.Header().Set("Content-Type", "image/jpeg")
+	case thumbnailsVTT:
+		w.Header().Set("Content-Type", "text/vtt")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	// Entries never change, a changed source gets a new hash
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(thumbnails.dir, hash, file))
+}